@@ -11,7 +11,7 @@ import (
 )
 
 type Api interface {
-	BuildQueryRequest(ctx context.Context, datasource *CnosdbDatasource, sql string) (*http.Request, error)
+	BuildQueryRequest(ctx context.Context, datasource *CnosdbDatasource, target *QueryTarget, sql string) (*http.Request, error)
 
 	BuildPingRequest(ctx context.Context, datasource *CnosdbDatasource) (*http.Request, error)
 }
@@ -26,13 +26,8 @@ func NewCnosdbApi(options *CnosdbDataSourceOptions) (*CnosdbApi, error) {
 		return nil, err
 	}
 
+	// The database and tenant are added per request
 	queryUrlParams := queryUrl.Query()
-	if len(options.Database) > 0 {
-		queryUrlParams.Add("db", options.Database)
-	}
-	if len(options.Tenant) > 0 {
-		queryUrlParams.Add("tenant", options.Tenant)
-	}
 	if options.TargetPartitions != 0 {
 		queryUrlParams.Add("target_partitions", strconv.FormatInt(int64(options.TargetPartitions), 10))
 	}
@@ -49,8 +44,16 @@ func NewCnosdbApi(options *CnosdbDataSourceOptions) (*CnosdbApi, error) {
 	}, nil
 }
 
-func (c *CnosdbApi) BuildQueryRequest(ctx context.Context, d *CnosdbDatasource, sql string) (*http.Request, error) {
+func (c *CnosdbApi) BuildQueryRequest(ctx context.Context, d *CnosdbDatasource, target *QueryTarget, sql string) (*http.Request, error) {
 	queryUrl := c.queryUrl.JoinPath("api/v1/sql")
+	queryUrlParams := queryUrl.Query()
+	if len(target.Database) > 0 {
+		queryUrlParams.Set("db", target.Database)
+	}
+	if len(target.Tenant) > 0 {
+		queryUrlParams.Set("tenant", target.Tenant)
+	}
+	queryUrl.RawQuery = queryUrlParams.Encode()
 
 	req, err := http.NewRequestWithContext(ctx, "POST", queryUrl.String(), strings.NewReader(sql))
 	if err != nil {
@@ -58,8 +61,8 @@ func (c *CnosdbApi) BuildQueryRequest(ctx context.Context, d *CnosdbDatasource,
 	}
 	req.Header.Set("Accept", "application/json")
 
-	if d.httpOptions.BasicAuth != nil {
-		req.SetBasicAuth(d.httpOptions.BasicAuth.User, d.httpOptions.BasicAuth.Password)
+	if err = d.setAuthentication(req, target); err != nil {
+		return nil, err
 	}
 
 	return req, err
@@ -73,9 +76,10 @@ func (c *CnosdbApi) BuildPingRequest(ctx context.Context, d *CnosdbDatasource) (
 
 type CnosdbCloudApi struct {
 	queryUrl *url.URL
+	apiKey   string
 }
 
-func NewCnosdbCloudApi(options *CnosdbDataSourceOptions) (*CnosdbCloudApi, error) {
+func NewCnosdbCloudApi(options *CnosdbDataSourceOptions, apiKey string) (*CnosdbCloudApi, error) {
 	queryUrl, err := options.buildCnosdbUrl()
 	if err != nil {
 		return nil, err
@@ -95,13 +99,15 @@ func NewCnosdbCloudApi(options *CnosdbDataSourceOptions) (*CnosdbCloudApi, error
 
 	return &CnosdbCloudApi{
 		queryUrl: queryUrl,
+		apiKey:   apiKey,
 	}, nil
 }
 
-func (c *CnosdbCloudApi) BuildQueryRequest(ctx context.Context, d *CnosdbDatasource, sql string) (*http.Request, error) {
+func (c *CnosdbCloudApi) BuildQueryRequest(ctx context.Context, d *CnosdbDatasource, target *QueryTarget, sql string) (*http.Request, error) {
+	// The SQL API of CnosDB cloud reads the API key from the body
 	dataJson, err := json.Marshal(map[string]interface{}{
-		"apikey":   d.options.ApiKey,
-		"database": d.options.Database,
+		"apikey":   c.apiKey,
+		"database": target.Database,
 		"sql":      sql,
 	})
 	if err != nil {
@@ -119,10 +125,9 @@ func (c *CnosdbCloudApi) BuildQueryRequest(ctx context.Context, d *CnosdbDatasou
 	return req, nil
 }
 
+// BuildPingRequest runs a query instead of pinging /api/v1/ping, which CnosDB cloud only authenticates
+// by the apikey URL parameter that proxies and access logs record. The SQL API reads the API key from
+// the body, its response doesn't tell the server version though.
 func (c *CnosdbCloudApi) BuildPingRequest(ctx context.Context, d *CnosdbDatasource) (*http.Request, error) {
-	queryUrl := c.queryUrl.JoinPath("api/v1/ping")
-	queryUrlParams := url.Values{}
-	queryUrlParams.Set("apikey", d.options.ApiKey)
-	queryUrl.RawQuery = queryUrlParams.Encode()
-	return http.NewRequestWithContext(ctx, "GET", queryUrl.String(), nil)
+	return c.BuildQueryRequest(ctx, d, d.queryTarget(ctx), "SELECT 1")
 }
@@ -0,0 +1,59 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+type AuthType string
+
+const (
+	// AuthTypeBasic uses the basic auth user and password of the datasource, it is the default.
+	AuthTypeBasic AuthType = "basic"
+	// AuthTypeBearerToken uses the static token stored in the secure JSON data as bearerToken.
+	AuthTypeBearerToken AuthType = "bearerToken"
+	// AuthTypeOAuthPassThrough forwards the OAuth identity of the signed-in Grafana user.
+	AuthTypeOAuthPassThrough AuthType = "oauthPassThrough"
+)
+
+var errNoOAuthIdentity = errors.New("no OAuth identity to forward, the Grafana user must sign in with OAuth")
+
+type forwardedHeadersKey struct{}
+
+// withForwardedHeaders stores the HTTP headers Grafana forwards with a request, e.g. the OAuth
+// identity of the signed-in user.
+func withForwardedHeaders(ctx context.Context, req backend.ForwardHTTPHeaders) context.Context {
+	return context.WithValue(ctx, forwardedHeadersKey{}, req.GetHTTPHeaders())
+}
+
+func forwardedHeaders(ctx context.Context) http.Header {
+	headers, _ := ctx.Value(forwardedHeadersKey{}).(http.Header)
+	return headers
+}
+
+// setAuthentication authenticates a request to CnosDB by the auth type of the datasource, basic auth
+// uses the credentials of the query target.
+func (d *CnosdbDatasource) setAuthentication(req *http.Request, target *QueryTarget) error {
+	switch d.options.AuthType {
+	case AuthTypeBearerToken:
+		req.Header.Set("Authorization", "Bearer "+d.bearerToken)
+	case AuthTypeOAuthPassThrough:
+		headers := forwardedHeaders(req.Context())
+		authorization := headers.Get(backend.OAuthIdentityTokenHeaderName)
+		if authorization == "" {
+			return errNoOAuthIdentity
+		}
+		req.Header.Set("Authorization", authorization)
+		if idToken := headers.Get(backend.OAuthIdentityIDTokenHeaderName); idToken != "" {
+			req.Header.Set(backend.OAuthIdentityIDTokenHeaderName, idToken)
+		}
+	default:
+		if target.BasicAuth != nil {
+			req.SetBasicAuth(target.BasicAuth.User, target.BasicAuth.Password)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cnosdb/cnos-cnosdb-datasource-backend/pkg/plugin"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryDataAuthentication(t *testing.T) {
+	var authorization, idToken string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		idToken = r.Header.Get("X-Id-Token")
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		name          string
+		options       map[string]interface{}
+		secure        map[string]string
+		headers       map[string]string
+		status        backend.Status
+		authorization string
+		idToken       string
+	}{
+		{
+			name:          "basic",
+			options:       map[string]interface{}{"basicAuth": true, "basicAuthUser": "root"},
+			secure:        map[string]string{"basicAuthPassword": "pass"},
+			authorization: "Basic cm9vdDpwYXNz",
+		},
+		{
+			name:          "bearer token",
+			options:       map[string]interface{}{"authType": "bearerToken", "basicAuth": true, "basicAuthUser": "root"},
+			secure:        map[string]string{"bearerToken": "token"},
+			authorization: "Bearer token",
+		},
+		{
+			name:          "oauth pass-through",
+			options:       map[string]interface{}{"authType": "oauthPassThrough"},
+			headers:       map[string]string{"Authorization": "Bearer user-token", "X-Id-Token": "id-token"},
+			authorization: "Bearer user-token",
+			idToken:       "id-token",
+		},
+		{
+			name:    "oauth pass-through without identity",
+			options: map[string]interface{}{"authType": "oauthPassThrough"},
+			status:  backend.StatusUnauthorized,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			authorization, idToken = "", ""
+			c.options["url"] = server.URL
+			jsonData, _ := json.Marshal(c.options)
+			instance, err := plugin.NewCnosdbDatasource(backend.DataSourceInstanceSettings{
+				BasicAuthEnabled:        c.options["basicAuth"] == true,
+				BasicAuthUser:           "root",
+				JSONData:                jsonData,
+				DecryptedSecureJSONData: c.secure,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := instance.(*plugin.CnosdbDatasource).QueryData(
+				context.Background(),
+				&backend.QueryDataRequest{
+					Headers: c.headers,
+					Queries: []backend.DataQuery{{
+						RefID: "A",
+						JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT 1"}`),
+					}},
+				},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res := resp.Responses["A"]
+			if c.status != 0 {
+				assert.Equal(t, c.status, res.Status)
+				return
+			}
+			assert.NoError(t, res.Error)
+			assert.Equal(t, c.authorization, authorization)
+			assert.Equal(t, c.idToken, idToken)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// KillQueryTimeout is the time spent on killing a cancelled query.
+const KillQueryTimeout = 5 * time.Second
+
+// CnosDB doesn't let clients choose the id of a query, so a cancellable query is tagged with a comment
+// holding a random id, and its CnosDB query id is looked up by the comment in SHOW QUERIES.
+const queryIDComment = "/* grafana_query_id=%s */ "
+
+// newQueryID returns a random id tagging a query.
+func newQueryID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// tagQuery prefixes sql with the comment holding id.
+func tagQuery(sql string, id string) string {
+	return fmt.Sprintf(queryIDComment, id) + sql
+}
+
+// detachContext returns a context carrying the forwarded headers of ctx, which is not cancelled with ctx.
+func detachContext(ctx context.Context) context.Context {
+	return context.WithValue(context.Background(), forwardedHeadersKey{}, forwardedHeaders(ctx))
+}
+
+// cancelledError returns the error of a request which failed because ctx is done, after starting to
+// kill the query tagged with id if there is one.
+func (d *CnosdbDatasource) cancelledError(ctx context.Context, target *QueryTarget, id string, err error) *StatusError {
+	if ctx.Err() == nil {
+		return ConnectionError(err)
+	}
+	if id != "" {
+		go d.killQuery(ctx, target, id)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		statusErr := NewDownstreamError(backend.StatusTimeout, "the query timed out")
+		statusErr.Hint = "narrow the time range of the query or increase its timeout"
+		return statusErr
+	}
+	return NewDownstreamError(backend.StatusTimeout, "the query was cancelled")
+}
+
+// killQuery kills the query tagged with id on CnosDB, it is called when the query is cancelled by
+// Grafana or has timed out. Failures are logged, the query then runs to completion on CnosDB.
+func (d *CnosdbDatasource) killQuery(ctx context.Context, target *QueryTarget, id string) {
+	ctx, cancel := context.WithTimeout(detachContext(ctx), KillQueryTimeout)
+	defer cancel()
+
+	queries, err := d.runInternalStatement(ctx, target, "SHOW QUERIES")
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to list the running CnosDB queries", "error", err)
+		return
+	}
+	comment := fmt.Sprintf(queryIDComment, id)
+	for _, query := range queries {
+		text, _ := query["query_text"].(string)
+		if !strings.Contains(text, comment) {
+			continue
+		}
+		cnosdbQueryID := fmt.Sprint(query["query_id"])
+		if _, err := d.runInternalStatement(ctx, target, "KILL QUERY "+cnosdbQueryID); err != nil {
+			log.DefaultLogger.Warn("Failed to kill the cancelled CnosDB query", "queryId", cnosdbQueryID, "error", err)
+			return
+		}
+		log.DefaultLogger.Debug("Killed the cancelled CnosDB query", "queryId", cnosdbQueryID)
+		return
+	}
+}
+
+// runInternalStatement runs a statement of the plugin itself and returns the rows of its result.
+func (d *CnosdbDatasource) runInternalStatement(ctx context.Context, target *QueryTarget, sql string) ([]map[string]interface{}, error) {
+	req, err := d.api.BuildQueryRequest(ctx, d, target, sql)
+	if err != nil {
+		return nil, err
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, ParseCnosdbError(res, body).StatusError()
+	}
+	var rows []map[string]interface{}
+	if len(body) == 0 {
+		return rows, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// Query ids may not fit in a float64
+	decoder.UseNumber()
+	if err := decoder.Decode(&rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
@@ -0,0 +1,133 @@
+package plugin_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowQueryHandler answers pings and SHOW QUERIES, other queries run until they are cancelled.
+type slowQueryHandler struct {
+	mu      sync.Mutex
+	running string
+	killed  []string
+}
+
+func (h *slowQueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/v1/ping" {
+		_, _ = w.Write([]byte(`{"version":"2.3.0","status":"healthy"}`))
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	sql := string(body)
+	switch {
+	case sql == "SHOW QUERIES":
+		h.mu.Lock()
+		running := strings.ReplaceAll(h.running, `"`, `\"`)
+		h.mu.Unlock()
+		_, _ = w.Write([]byte(`[{"query_id":7,"query_text":"SHOW QUERIES"},{"query_id":18446744073709551615,"query_text":"` + running + `"}]`))
+	case strings.HasPrefix(sql, "KILL QUERY"):
+		h.mu.Lock()
+		h.killed = append(h.killed, sql)
+		h.mu.Unlock()
+	default:
+		h.mu.Lock()
+		h.running = sql
+		h.mu.Unlock()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (h *slowQueryHandler) Killed() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.killed...)
+}
+
+func TestQueryDataTimeout(t *testing.T) {
+	ds := newTestDatasourceWithOptions(t, (&slowQueryHandler{}).ServeHTTP, map[string]interface{}{"queryTimeout": "50ms"})
+
+	start := time.Now()
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID: "A",
+		JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT * FROM cpu"}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resp.Responses["A"]
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, backend.StatusTimeout, res.Status)
+	assert.EqualError(t, res.Error, "the query timed out (narrow the time range of the query or increase its timeout)")
+}
+
+func TestQueryDataTimeoutOverride(t *testing.T) {
+	ds := newTestDatasourceWithOptions(t, (&slowQueryHandler{}).ServeHTTP, map[string]interface{}{"queryTimeout": "1h"})
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID: "A",
+		JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT * FROM cpu","timeout":"50ms"}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, backend.StatusTimeout, resp.Responses["A"].Status)
+
+	resp, err = ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID: "A",
+		JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT * FROM cpu","timeout":"soon"}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, backend.StatusValidationFailed, resp.Responses["A"].Status)
+	assert.EqualError(t, resp.Responses["A"].Error, `invalid query timeout "soon"`)
+}
+
+func TestQueryDataKillsCancelledQuery(t *testing.T) {
+	handler := &slowQueryHandler{}
+	ds := newTestDatasourceWithOptions(t, handler.ServeHTTP, map[string]interface{}{"killQueryOnCancel": true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	resp, err := ds.QueryData(ctx, &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID: "A",
+		JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT * FROM cpu"}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resp.Responses["A"]
+	assert.EqualError(t, res.Error, "the query was cancelled")
+	// The executed query is reported without the id
+	assert.Equal(t, "SELECT * FROM cpu", res.Frames[0].Meta.ExecutedQueryString)
+
+	assert.Eventually(t, func() bool { return len(handler.Killed()) > 0 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"KILL QUERY 18446744073709551615"}, handler.Killed())
+}
+
+func TestQueryDataDoesNotKillWithoutOption(t *testing.T) {
+	handler := &slowQueryHandler{}
+	ds := newTestDatasourceWithOptions(t, handler.ServeHTTP, map[string]interface{}{"queryTimeout": "50ms"})
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID: "A",
+		JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT * FROM cpu"}`),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, backend.StatusTimeout, resp.Responses["A"].Status)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, handler.Killed())
+}
@@ -0,0 +1,202 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// Capabilities is the SQL syntax supported by a CnosDB server, it is derived from the server version.
+type Capabilities struct {
+	Version string `json:"version,omitempty"`
+	// DateBin is true if time buckets of any interval can be computed by DATE_BIN, otherwise only
+	// buckets of one unit are supported by date_trunc.
+	DateBin bool `json:"dateBin"`
+	// Gapfill is true if empty time buckets can be filled by the server with date_bin_gapfill and locf.
+	Gapfill bool `json:"gapfill"`
+	// QuotedTagKey is true if the key of SHOW TAG VALUES ... WITH KEY can be a quoted identifier.
+	QuotedTagKey bool `json:"quotedTagKey"`
+}
+
+// DefaultCapabilities is used if the server version is unknown, it is the syntax of the oldest
+// release supporting DATE_BIN.
+var DefaultCapabilities = Capabilities{DateBin: true, QuotedTagKey: true}
+
+var regexpVersion = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// CapabilitiesOf returns the capabilities of a CnosDB version, e.g. "2.3.0" or "v2.4.1-beta".
+//
+//	< 2.1:  date_trunc instead of DATE_BIN, unquoted tag keys
+//	2.1:    DATE_BIN
+//	2.2:    quoted tag keys
+//	>= 2.3: date_bin_gapfill, locf
+func CapabilitiesOf(version string) Capabilities {
+	match := regexpVersion.FindStringSubmatch(version)
+	if match == nil {
+		caps := DefaultCapabilities
+		caps.Version = version
+		return caps
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	atLeast := func(wantMajor int, wantMinor int) bool {
+		return major > wantMajor || (major == wantMajor && minor >= wantMinor)
+	}
+	return Capabilities{
+		Version:      version,
+		DateBin:      atLeast(2, 1),
+		QuotedTagKey: atLeast(2, 2),
+		Gapfill:      atLeast(2, 3),
+	}
+}
+
+// dateTruncUnits are the intervals supported without DATE_BIN.
+var dateTruncUnits = map[string]string{
+	"1 second": "second",
+	"1 minute": "minute",
+	"1 hour":   "hour",
+	"1 day":    "day",
+}
+
+// timeBucket returns the expression of the time bucket of column for an interval formatted by
+// FormatIntervalString.
+func (c Capabilities) timeBucket(interval string, column string) (string, error) {
+	if c.DateBin {
+		return fmt.Sprintf("DATE_BIN(INTERVAL '%s', %s, TIMESTAMP '1970-01-01T00:00:00Z')", interval, column), nil
+	}
+	unit, ok := dateTruncUnits[interval]
+	if !ok {
+		return "", fmt.Errorf("interval %q is not supported by CnosDB %s, use 1 second, minute, hour or day", interval, c.Version)
+	}
+	return fmt.Sprintf("date_trunc('%s', %s)", unit, column), nil
+}
+
+var regexpTagValuesKey = regexp.MustCompile(`(?i)(\bWITH\s+KEY\s*=\s*)"((?:[^"]|"")*)"`)
+
+// rewriteMetadataQuery adapts SHOW TAG VALUES ... WITH KEY = "key" to servers not supporting quoted
+// tag keys.
+func (c Capabilities) rewriteMetadataQuery(sql string) string {
+	if c.QuotedTagKey || !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(sql)), "SHOW TAG VALUES") {
+		return sql
+	}
+	return regexpTagValuesKey.ReplaceAllStringFunc(sql, func(s string) string {
+		match := regexpTagValuesKey.FindStringSubmatch(s)
+		return match[1] + strings.ReplaceAll(match[2], `""`, `"`)
+	})
+}
+
+// errNoVersion is returned by a ping of a server which doesn't report its version, e.g. CnosDB cloud.
+var errNoVersion = errors.New("ping didn't return a version")
+
+const (
+	// VersionDetectionTimeout bounds the ping detecting the version, which queries wait for
+	VersionDetectionTimeout = 5 * time.Second
+	// VersionRetryInterval is the time DefaultCapabilities are used after the version detection failed
+	VersionRetryInterval = 30 * time.Second
+)
+
+// capabilities returns the capabilities of the server, the version is detected by a ping on first
+// use and cached. Concurrent queries wait for a single ping. If the ping fails, DefaultCapabilities
+// are returned and the ping is retried after VersionRetryInterval.
+func (d *CnosdbDatasource) capabilities(ctx context.Context) Capabilities {
+	d.capsMu.Lock()
+	if d.caps != nil {
+		caps := *d.caps
+		d.capsMu.Unlock()
+		return caps
+	}
+	if time.Now().Before(d.capsRetryAt) {
+		d.capsMu.Unlock()
+		return DefaultCapabilities
+	}
+	if detected := d.capsDetected; detected != nil {
+		d.capsMu.Unlock()
+		select {
+		case <-detected:
+		case <-ctx.Done():
+			return DefaultCapabilities
+		}
+		d.capsMu.Lock()
+		defer d.capsMu.Unlock()
+		if d.caps != nil {
+			return *d.caps
+		}
+		return DefaultCapabilities
+	}
+	detected := make(chan struct{})
+	d.capsDetected = detected
+	d.capsMu.Unlock()
+
+	pingCtx, cancel := context.WithTimeout(ctx, VersionDetectionTimeout)
+	version, err := d.detectVersion(pingCtx)
+	cancel()
+
+	d.capsMu.Lock()
+	defer d.capsMu.Unlock()
+	d.capsDetected = nil
+	close(detected)
+	if d.caps != nil {
+		// The version was set by a health check meanwhile
+		return *d.caps
+	}
+	if errors.Is(err, errNoVersion) {
+		// The server is healthy, but doesn't tell its version
+		caps := DefaultCapabilities
+		d.caps = &caps
+		return caps
+	}
+	if err != nil {
+		log.DefaultLogger.Warn("Failed to detect the CnosDB version", "error", err)
+		// A cancelled query doesn't tell whether the server is down
+		if ctx.Err() == nil {
+			d.capsRetryAt = time.Now().Add(VersionRetryInterval)
+		}
+		return DefaultCapabilities
+	}
+	caps := CapabilitiesOf(version)
+	d.caps = &caps
+	return caps
+}
+
+// setVersion caches the capabilities of a version reported by the server, e.g. by CheckHealth.
+func (d *CnosdbDatasource) setVersion(version string) {
+	caps := CapabilitiesOf(version)
+	d.capsMu.Lock()
+	d.caps = &caps
+	d.capsMu.Unlock()
+}
+
+func (d *CnosdbDatasource) detectVersion(ctx context.Context) (string, error) {
+	req, err := d.api.BuildPingRequest(ctx, d)
+	if err != nil {
+		return "", err
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode/100 != 2 {
+		return "", fmt.Errorf("ping returned %s", res.Status)
+	}
+	ping, err := parsePingResponse(body)
+	if err != nil {
+		return "", err
+	}
+	if ping.Version == "" {
+		return "", errNoVersion
+	}
+	return ping.Version, nil
+}
@@ -0,0 +1,277 @@
+package plugin_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cnosdb/cnos-cnosdb-datasource-backend/pkg/plugin"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilitiesOf(t *testing.T) {
+	tests := []struct {
+		version string
+		want    plugin.Capabilities
+	}{
+		{"2.0.2", plugin.Capabilities{Version: "2.0.2"}},
+		{"2.1.0", plugin.Capabilities{Version: "2.1.0", DateBin: true}},
+		{"v2.2.1", plugin.Capabilities{Version: "v2.2.1", DateBin: true, QuotedTagKey: true}},
+		{"2.3.0", plugin.Capabilities{Version: "2.3.0", DateBin: true, QuotedTagKey: true, Gapfill: true}},
+		{"2.4.0-beta (1a2b3c)", plugin.Capabilities{Version: "2.4.0-beta (1a2b3c)", DateBin: true, QuotedTagKey: true, Gapfill: true}},
+		{"3.0", plugin.Capabilities{Version: "3.0", DateBin: true, QuotedTagKey: true, Gapfill: true}},
+		{"unknown", plugin.Capabilities{Version: "unknown", DateBin: true, QuotedTagKey: true}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, plugin.CapabilitiesOf(tt.version), tt.version)
+	}
+}
+
+func buildForVersion(t *testing.T, version string, requestJson string) (string, error) {
+	caps := plugin.CapabilitiesOf(version)
+	return buildQuery(t, requestJson, plugin.CnosdbDataSourceOptions{}, &caps)
+}
+
+func TestBuildTimeBucketPerVersion(t *testing.T) {
+	query := func(interval string, fill string) string {
+		return `{
+    "table": "mq",
+    "select": [[
+        { "type": "field", "params": [ "fa" ] },
+        { "type": "avg" },
+        { "type": "alias", "params": [ "v" ] }
+    ]],
+    "groupBy": [
+        { "type": "time", "params": [ "` + interval + `" ] },
+        { "type": "fill", "params": [ "` + fill + `" ] }
+    ],
+    "orderByTime": "ASC"
+}`
+	}
+	const where = " FROM mq WHERE time >= 1665360000000000000 AND time <= 1665964800000000000"
+
+	tests := []struct {
+		name     string
+		version  string
+		interval string
+		fill     string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "date_trunc before 2.1",
+			version:  "2.0.0",
+			interval: "1 hour",
+			fill:     "null",
+			want: `SELECT date_trunc('hour', time) AS time, avg("fa") AS "v"` + where +
+				` GROUP BY date_trunc('hour', time) ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:     "interval not supported before 2.1",
+			version:  "2.0.0",
+			interval: "10 minutes",
+			fill:     "null",
+			wantErr:  true,
+		},
+		{
+			name:     "DATE_BIN without gapfill",
+			version:  "2.2.0",
+			interval: "10 minutes",
+			fill:     "previous",
+			want: `SELECT DATE_BIN(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z') AS time, avg("fa") AS "v"` + where +
+				` GROUP BY DATE_BIN(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z') ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:     "gapfill with null",
+			version:  "2.3.0",
+			interval: "10 minutes",
+			fill:     "null",
+			want: `SELECT date_bin_gapfill(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z') AS time, avg("fa") AS "v"` + where +
+				` GROUP BY date_bin_gapfill(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z') ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:     "gapfill with previous",
+			version:  "2.3.0",
+			interval: "10 minutes",
+			fill:     "previous",
+			want: `SELECT date_bin_gapfill(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z') AS time, locf(avg("fa")) AS "v"` + where +
+				` GROUP BY date_bin_gapfill(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z') ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:     "value fill is resampled",
+			version:  "2.3.0",
+			interval: "10 minutes",
+			fill:     "0",
+			want: `SELECT DATE_BIN(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z') AS time, avg("fa") AS "v"` + where +
+				` GROUP BY DATE_BIN(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z') ORDER BY time ASC LIMIT 1000`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, err := buildForVersion(t, tt.version, query(tt.interval, tt.fill))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, sql)
+		})
+	}
+}
+
+func TestBuildTimeGroupMacroPerVersion(t *testing.T) {
+	requestJson := `{"rawQuery": true, "queryText": "SELECT $__timeGroupAlias(time, 1m), avg(fa) FROM mq GROUP BY 1"}`
+
+	sql, err := buildForVersion(t, "2.0.0", requestJson)
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT date_trunc('minute', time) AS "time", avg(fa) FROM mq GROUP BY 1`, sql)
+
+	sql, err = buildForVersion(t, "2.3.0", requestJson)
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT DATE_BIN(INTERVAL '1 minute', time, TIMESTAMP '1970-01-01T00:00:00Z') AS "time", avg(fa) FROM mq GROUP BY 1`, sql)
+}
+
+func TestBuildShowTagValuesPerVersion(t *testing.T) {
+	requestJson := `{"rawQuery": true, "queryText": "SHOW TAG VALUES FROM mq WITH KEY = \"host\"\"name\""}`
+
+	sql, err := buildForVersion(t, "2.1.0", requestJson)
+	assert.NoError(t, err)
+	assert.Equal(t, `SHOW TAG VALUES FROM mq WITH KEY = host"name`, sql)
+
+	sql, err = buildForVersion(t, "2.2.0", requestJson)
+	assert.NoError(t, err)
+	assert.Equal(t, `SHOW TAG VALUES FROM mq WITH KEY = "host""name"`, sql)
+}
+
+func TestQueryDataDetectsVersionOnce(t *testing.T) {
+	var pings int32
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/ping" {
+			atomic.AddInt32(&pings, 1)
+			_, _ = w.Write([]byte(`{"version":"2.0.0","status":"healthy"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","value":1.5}]`))
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+			RefID: "A",
+			JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT $__timeGroupAlias(time, 1h), avg(value) FROM t GROUP BY 1"}`),
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := resp.Responses["A"]
+		assert.NoError(t, res.Error)
+		assert.Equal(t, `SELECT date_trunc('hour', time) AS "time", avg(value) FROM t GROUP BY 1`, res.Frames[0].Meta.ExecutedQueryString)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pings))
+}
+
+func TestQueryDataCachesFailedVersionDetection(t *testing.T) {
+	var pings int32
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/ping" {
+			if atomic.AddInt32(&pings, 1) == 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write([]byte(`{"version":"2.0.0","status":"healthy"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","value":1.5}]`))
+	})
+
+	executeQuery := func() string {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+			RefID: "A",
+			JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT $__timeGroupAlias(time, 1h), avg(value) FROM t GROUP BY 1"}`),
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, resp.Responses["A"].Error)
+		return resp.Responses["A"].Frames[0].Meta.ExecutedQueryString
+	}
+
+	// The default capabilities are used until the detection is retried
+	assert.Contains(t, executeQuery(), "DATE_BIN")
+	assert.Contains(t, executeQuery(), "DATE_BIN")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pings))
+
+	// A health check detects the version
+	_, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	assert.NoError(t, err)
+	assert.Contains(t, executeQuery(), "date_trunc('hour', time)")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&pings))
+}
+
+func TestQueryDataCloudKeepsDefaultCapabilities(t *testing.T) {
+	var pings int32
+	ds := newTestDatasourceWithOptions(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/sql", r.URL.Path)
+		assert.Empty(t, r.URL.Query().Get("apikey"))
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"sql":"SELECT 1"`) {
+			atomic.AddInt32(&pings, 1)
+			_, _ = w.Write([]byte(`[{"Int64(1)":1}]`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","value":1.5}]`))
+	}, map[string]interface{}{"cnosdbMode": 1, "apiKey": "secret"})
+
+	// The cloud doesn't tell its version, the default capabilities are kept without pinging again
+	for i := 0; i < 2; i++ {
+		resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+			RefID: "A",
+			JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT $__timeGroupAlias(time, 1h), avg(value) FROM t GROUP BY 1"}`),
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, resp.Responses["A"].Error)
+		assert.Contains(t, resp.Responses["A"].Frames[0].Meta.ExecutedQueryString, "DATE_BIN")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pings))
+}
+
+func TestQueryDataDetectsVersionOnceForConcurrentQueries(t *testing.T) {
+	var pings int32
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/ping" {
+			atomic.AddInt32(&pings, 1)
+			time.Sleep(50 * time.Millisecond)
+			_, _ = w.Write([]byte(`{"version":"2.0.0","status":"healthy"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","value":1.5}]`))
+	})
+
+	var wg sync.WaitGroup
+	executed := make([]string, 8)
+	for i := range executed {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+				RefID: "A",
+				JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT $__timeGroupAlias(time, 1h), avg(value) FROM t GROUP BY 1"}`),
+			}}})
+			if err == nil && resp.Responses["A"].Error == nil {
+				executed[i] = resp.Responses["A"].Frames[0].Meta.ExecutedQueryString
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pings))
+	for _, sql := range executed {
+		assert.Contains(t, sql, "date_trunc('hour', time)")
+	}
+}
@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	DefaultMaxRows  = 1000000
+	DefaultMaxBytes = 256 << 20
+)
+
+// ResponseLimits bounds the response of a query decoded by the plugin, so that a large result
+// is truncated instead of exhausting the memory of the plugin.
+type ResponseLimits struct {
+	MaxRows  int
+	MaxBytes int64
+}
+
+// decodeResult is the result of decodeRows.
+type decodeResult struct {
+	Rows      []map[string]interface{}
+	BytesRead int64
+	// Truncated describes the limit the rows were truncated by, it is empty if all rows were decoded
+	Truncated string
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decodeRows decodes the JSON array of rows of a query response row by row. It stops after MaxRows
+// rows, or when more than MaxBytes bytes would be read, and returns the rows decoded until then.
+func decodeRows(body io.Reader, limits ResponseLimits) (*decodeResult, error) {
+	limited := &io.LimitedReader{R: body, N: limits.MaxBytes + 1}
+	counter := &countingReader{r: limited}
+	decoder := json.NewDecoder(counter)
+	result := &decodeResult{}
+	defer func() {
+		result.BytesRead = counter.n
+	}()
+
+	exceeded := func() bool {
+		return limited.N <= 0
+	}
+
+	token, err := decoder.Token()
+	if errors.Is(err, io.EOF) {
+		return result, nil
+	}
+	if err != nil {
+		if exceeded() {
+			result.Truncated = fmt.Sprintf("the response exceeded the maximum size of %d bytes", limits.MaxBytes)
+			return result, nil
+		}
+		return result, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return result, fmt.Errorf("expected an array of rows, got %v", token)
+	}
+
+	for decoder.More() {
+		if len(result.Rows) >= limits.MaxRows {
+			result.Truncated = fmt.Sprintf("the result exceeded the maximum of %d rows", limits.MaxRows)
+			return result, nil
+		}
+		var row map[string]interface{}
+		if err := decoder.Decode(&row); err != nil {
+			if exceeded() {
+				result.Truncated = fmt.Sprintf("the response exceeded the maximum size of %d bytes", limits.MaxBytes)
+				return result, nil
+			}
+			return result, err
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return result, nil
+}
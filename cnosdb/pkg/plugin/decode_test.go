@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeRows(t *testing.T) {
+	body := `[{"time":"2022-10-10T00:00:00","value":1},{"time":"2022-10-10T00:01:00","value":2},{"time":"2022-10-10T00:02:00","value":3}]`
+	firstRow := len(`[{"time":"2022-10-10T00:00:00","value":1}`)
+
+	tests := []struct {
+		name      string
+		body      string
+		limits    ResponseLimits
+		rows      int
+		truncated string
+		wantErr   bool
+	}{
+		{name: "all rows", body: body, limits: ResponseLimits{MaxRows: 3, MaxBytes: int64(len(body))}, rows: 3},
+		{name: "empty body", body: "", limits: ResponseLimits{MaxRows: 3, MaxBytes: 100}, rows: 0},
+		{name: "no rows", body: "[]", limits: ResponseLimits{MaxRows: 3, MaxBytes: 100}, rows: 0},
+		{
+			name:      "max rows",
+			body:      body,
+			limits:    ResponseLimits{MaxRows: 2, MaxBytes: 1000},
+			rows:      2,
+			truncated: "the result exceeded the maximum of 2 rows",
+		},
+		{
+			name:      "max bytes",
+			body:      body,
+			limits:    ResponseLimits{MaxRows: 10, MaxBytes: int64(firstRow + 10)},
+			rows:      1,
+			truncated: "the response exceeded the maximum size of 51 bytes",
+		},
+		{
+			name:      "max bytes before the first row",
+			body:      body,
+			limits:    ResponseLimits{MaxRows: 10, MaxBytes: 0},
+			rows:      0,
+			truncated: "the response exceeded the maximum size of 0 bytes",
+		},
+		{name: "not an array", body: `{"error":"x"}`, limits: ResponseLimits{MaxRows: 10, MaxBytes: 100}, wantErr: true},
+		{name: "invalid row", body: `[{"a":1},2]`, limits: ResponseLimits{MaxRows: 10, MaxBytes: 100}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := decodeRows(strings.NewReader(tt.body), tt.limits)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, result.Rows, tt.rows)
+			assert.Equal(t, tt.truncated, result.Truncated)
+			assert.LessOrEqual(t, result.BytesRead, tt.limits.MaxBytes+1)
+		})
+	}
+}
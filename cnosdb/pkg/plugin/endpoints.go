@@ -0,0 +1,205 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type LoadBalancing string
+
+const (
+	LoadBalancingRoundRobin   LoadBalancing = "roundRobin"
+	LoadBalancingLeastLatency LoadBalancing = "leastLatency"
+
+	DefaultEndpointCooldown = 30 * time.Second
+	// EndpointMaxFailures is the number of consecutive failures after which an endpoint is ejected.
+	EndpointMaxFailures = 3
+	// endpointLatencyWeight is the weight of the latest request in the moving average latency.
+	endpointLatencyWeight = 0.3
+)
+
+// Endpoint is a CnosDB query node.
+type Endpoint struct {
+	Url *url.URL
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+	latency      time.Duration
+	lastError    string
+}
+
+// EndpointState is the health of an endpoint.
+type EndpointState struct {
+	Url       string `json:"url"`
+	Healthy   bool   `json:"healthy"`
+	Failures  int    `json:"failures"`
+	LatencyMs int64  `json:"latencyMs"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// EndpointPool selects the endpoint of each request and tracks the health of endpoints passively,
+// by the results of requests. Endpoints failing EndpointMaxFailures times in a row are ejected for
+// a cool-down, unless all endpoints are ejected.
+type EndpointPool struct {
+	endpoints     []*Endpoint
+	loadBalancing LoadBalancing
+	cooldown      time.Duration
+	next          uint32
+}
+
+func NewEndpointPool(urls []*url.URL, loadBalancing LoadBalancing, cooldown time.Duration) (*EndpointPool, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no endpoint")
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultEndpointCooldown
+	}
+	pool := &EndpointPool{loadBalancing: loadBalancing, cooldown: cooldown}
+	for _, u := range urls {
+		pool.endpoints = append(pool.endpoints, &Endpoint{Url: u})
+	}
+	return pool, nil
+}
+
+func (p *EndpointPool) Endpoints() []*Endpoint {
+	return p.endpoints
+}
+
+// Next returns the endpoint of the next request.
+func (p *EndpointPool) Next() *Endpoint {
+	if len(p.endpoints) == 1 {
+		return p.endpoints[0]
+	}
+
+	now := time.Now()
+	var candidates []*Endpoint
+	for _, ep := range p.endpoints {
+		if ep.available(now) {
+			candidates = append(candidates, ep)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.endpoints
+	}
+
+	if p.loadBalancing == LoadBalancingLeastLatency {
+		best := candidates[0]
+		bestLatency := best.averageLatency()
+		for _, ep := range candidates[1:] {
+			// Endpoints without latency have not been tried yet, so they are preferred.
+			if latency := ep.averageLatency(); latency < bestLatency {
+				best, bestLatency = ep, latency
+			}
+		}
+		return best
+	}
+	i := atomic.AddUint32(&p.next, 1) - 1
+	return candidates[int(i%uint32(len(candidates)))]
+}
+
+// State returns the health of all endpoints.
+func (p *EndpointPool) State() []EndpointState {
+	now := time.Now()
+	states := make([]EndpointState, len(p.endpoints))
+	for i, ep := range p.endpoints {
+		ep.mu.Lock()
+		states[i] = EndpointState{
+			Url:       ep.Url.String(),
+			Healthy:   !now.Before(ep.ejectedUntil),
+			Failures:  ep.failures,
+			LatencyMs: ep.latency.Milliseconds(),
+			LastError: ep.lastError,
+		}
+		ep.mu.Unlock()
+	}
+	return states
+}
+
+func (ep *Endpoint) available(now time.Time) bool {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return !now.Before(ep.ejectedUntil)
+}
+
+func (ep *Endpoint) averageLatency() time.Duration {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.latency
+}
+
+func (ep *Endpoint) reportSuccess(latency time.Duration) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.failures = 0
+	ep.ejectedUntil = time.Time{}
+	ep.lastError = ""
+	if ep.latency == 0 {
+		ep.latency = latency
+	} else {
+		ep.latency = time.Duration(endpointLatencyWeight*float64(latency) + (1-endpointLatencyWeight)*float64(ep.latency))
+	}
+}
+
+func (ep *Endpoint) reportFailure(err string, cooldown time.Duration) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.failures++
+	ep.lastError = err
+	if ep.failures >= EndpointMaxFailures {
+		ep.ejectedUntil = time.Now().Add(cooldown)
+	}
+}
+
+type endpointKey struct{}
+
+// withEndpoint pins a request to ep, e.g. to check the health of every endpoint.
+func withEndpoint(ctx context.Context, ep *Endpoint) context.Context {
+	return context.WithValue(ctx, endpointKey{}, ep)
+}
+
+// EndpointTransport sends each request to the endpoint selected by an EndpointPool, by replacing
+// the scheme and host of the request URL, and reports the result to the pool.
+type EndpointTransport struct {
+	next http.RoundTripper
+	pool *EndpointPool
+}
+
+func NewEndpointTransport(next http.RoundTripper, pool *EndpointPool) *EndpointTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &EndpointTransport{next: next, pool: pool}
+}
+
+func (t *EndpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ep, ok := req.Context().Value(endpointKey{}).(*Endpoint)
+	if !ok {
+		ep = t.pool.Next()
+	}
+
+	req = req.Clone(req.Context())
+	req.URL.Scheme = ep.Url.Scheme
+	req.URL.Host = ep.Url.Host
+	req.Host = ""
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil:
+		if req.Context().Err() == nil {
+			ep.reportFailure(err.Error(), t.pool.cooldown)
+		}
+	case res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable || res.StatusCode == http.StatusGatewayTimeout:
+		ep.reportFailure(fmt.Sprintf("status %s", res.Status), t.pool.cooldown)
+	default:
+		ep.reportSuccess(time.Since(start))
+	}
+	return res, err
+}
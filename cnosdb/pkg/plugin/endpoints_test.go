@@ -0,0 +1,124 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cnosdb/cnos-cnosdb-datasource-backend/pkg/plugin"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseUrls(t *testing.T, urls ...string) []*url.URL {
+	var res []*url.URL
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, u)
+	}
+	return res
+}
+
+func TestEndpointPoolRoundRobin(t *testing.T) {
+	pool, err := plugin.NewEndpointPool(mustParseUrls(t, "http://a:8902", "http://b:8902", "http://c:8902"), plugin.LoadBalancingRoundRobin, 0)
+	assert.NoError(t, err)
+
+	var hosts []string
+	for i := 0; i < 6; i++ {
+		hosts = append(hosts, pool.Next().Url.Host)
+	}
+	assert.Equal(t, []string{"a:8902", "b:8902", "c:8902", "a:8902", "b:8902", "c:8902"}, hosts)
+}
+
+func TestEndpointTransportFailover(t *testing.T) {
+	var requests int32
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	pool, err := plugin.NewEndpointPool(mustParseUrls(t, failing.URL, healthy.URL), plugin.LoadBalancingRoundRobin, time.Minute)
+	assert.NoError(t, err)
+	client := &http.Client{Transport: plugin.NewEndpointTransport(nil, pool)}
+
+	for i := 0; i < 2*plugin.EndpointMaxFailures; i++ {
+		res, err := client.Get("http://localhost/api/v1/ping")
+		assert.NoError(t, err)
+		res.Body.Close()
+	}
+	// The failing endpoint is ejected, all requests go to the healthy one.
+	for i := 0; i < 4; i++ {
+		res, err := client.Get("http://localhost/api/v1/ping")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		res.Body.Close()
+	}
+	assert.Equal(t, int32(plugin.EndpointMaxFailures+4), atomic.LoadInt32(&requests))
+
+	states := pool.State()
+	assert.False(t, states[0].Healthy)
+	assert.Equal(t, plugin.EndpointMaxFailures, states[0].Failures)
+	assert.True(t, states[1].Healthy)
+}
+
+func TestEndpointPoolLeastLatency(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer slow.Close()
+	var fastRequests int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fastRequests, 1)
+	}))
+	defer fast.Close()
+
+	pool, err := plugin.NewEndpointPool(mustParseUrls(t, slow.URL, fast.URL), plugin.LoadBalancingLeastLatency, 0)
+	assert.NoError(t, err)
+	client := &http.Client{Transport: plugin.NewEndpointTransport(nil, pool)}
+
+	for i := 0; i < 5; i++ {
+		res, err := client.Get("http://localhost/api/v1/ping")
+		assert.NoError(t, err)
+		res.Body.Close()
+	}
+	// The first request of each endpoint measures its latency.
+	assert.Equal(t, int32(4), atomic.LoadInt32(&fastRequests))
+}
+
+func TestCheckHealthEndpoints(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	downUrl, _ := url.Parse(down.URL)
+	down.Close()
+
+	ds := newTestDatasourceWithOptions(t, cnosdbHandler, map[string]interface{}{
+		"endpoints":     []string{downUrl.Host},
+		"retryAttempts": 1,
+	})
+
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, backend.HealthStatusOk, res.Status)
+	assert.True(t, strings.HasPrefix(res.Message, "Data source is working, CnosDB version 2.3.0, 1 of 2 endpoints failed"), res.Message)
+
+	var details struct {
+		Endpoints []plugin.EndpointState `json:"endpoints"`
+	}
+	assert.NoError(t, json.Unmarshal(res.JSONDetails, &details))
+	assert.Len(t, details.Endpoints, 2)
+	assert.Equal(t, 0, details.Endpoints[0].Failures)
+	assert.Equal(t, 1, details.Endpoints[1].Failures)
+	assert.NotEmpty(t, details.Endpoints[1].LastError)
+}
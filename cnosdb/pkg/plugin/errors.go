@@ -0,0 +1,206 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// ErrorSource tells whether an error was caused by the plugin or by CnosDB.
+type ErrorSource string
+
+const (
+	ErrorSourcePlugin     ErrorSource = "plugin"
+	ErrorSourceDownstream ErrorSource = "downstream"
+)
+
+var notFoundPhrases = []string{"not found", "not exist", "doesn't exist"}
+
+var regexpTableName = regexp.MustCompile("(?i)table[^\"'`]*[\"'`]([^\"'`]+)[\"'`]")
+
+// StatusError is an error of a query together with the status reported to Grafana.
+type StatusError struct {
+	Status  backend.Status
+	Source  ErrorSource
+	Code    string
+	Message string
+	Hint    string
+}
+
+func NewStatusError(status backend.Status, message string) *StatusError {
+	return &StatusError{Status: status, Source: ErrorSourcePlugin, Message: message}
+}
+
+// NewDownstreamError returns an error caused by CnosDB or by the connection to it.
+func NewDownstreamError(status backend.Status, message string) *StatusError {
+	return &StatusError{Status: status, Source: ErrorSourceDownstream, Message: message}
+}
+
+func (e *StatusError) Error() string {
+	if e.Hint != "" {
+		return fmt.Sprintf("%s (%s)", e.Message, e.Hint)
+	}
+	return e.Message
+}
+
+// StatusOf returns the status of err, or StatusInternal if err is not a StatusError.
+func StatusOf(err error) backend.Status {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status
+	}
+	return backend.StatusInternal
+}
+
+// ErrorMetaCustom is the metadata of a frame returned for a failed query.
+type ErrorMetaCustom struct {
+	ErrorSource ErrorSource `json:"errorSource,omitempty"`
+	ErrorCode   string      `json:"errorCode,omitempty"`
+	Hint        string      `json:"hint,omitempty"`
+}
+
+func NewErrorMetaCustom(err error) *ErrorMetaCustom {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return &ErrorMetaCustom{ErrorSource: ErrorSourcePlugin}
+	}
+	return &ErrorMetaCustom{
+		ErrorSource: statusErr.Source,
+		ErrorCode:   statusErr.Code,
+		Hint:        statusErr.Hint,
+	}
+}
+
+// CnosdbError is an error response of CnosDB.
+type CnosdbError struct {
+	HttpStatus int
+	Status     string
+	Code       string
+	Message    string
+}
+
+// ParseCnosdbError parses the body of a non-2xx response.
+func ParseCnosdbError(res *http.Response, body []byte) *CnosdbError {
+	cnosdbErr := &CnosdbError{HttpStatus: res.StatusCode, Status: res.Status}
+
+	var errMsg map[string]interface{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&errMsg); err != nil {
+		cnosdbErr.Message = fmt.Sprintf("Failed to parse response: %s", err)
+		return cnosdbErr
+	}
+	if code, ok := errMsg["error_code"]; ok {
+		cnosdbErr.Code = fmt.Sprint(code)
+		cnosdbErr.Message = fmt.Sprint(errMsg["error_message"])
+	} else if message, ok := errMsg["message"]; ok {
+		cnosdbErr.Message = fmt.Sprint(message)
+	}
+	return cnosdbErr
+}
+
+func (e *CnosdbError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("Query failed with status '%s', error code: %s, error: %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("Query failed with status '%s', error: %s", e.Status, e.Message)
+}
+
+// GrafanaStatus maps the error to the status reported to Grafana. A specific HTTP status decides,
+// CnosDB reports most errors with a generic status though, which are mapped by whole phrases of
+// the error message, so that e.g. "table author not found" isn't taken for an authentication error.
+func (e *CnosdbError) GrafanaStatus() backend.Status {
+	switch e.HttpStatus {
+	case http.StatusUnauthorized:
+		return backend.StatusUnauthorized
+	case http.StatusForbidden:
+		return backend.StatusForbidden
+	case http.StatusNotFound:
+		return backend.StatusNotFound
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return backend.StatusTimeout
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return backend.StatusTooManyRequests
+	}
+
+	msg := strings.ToLower(e.Message)
+	switch {
+	case containsPhrase(msg, "auth error", "authentication failed", "password mismatch", "invalid password",
+		"unauthorized", "invalid api key", "invalid apikey"):
+		return backend.StatusUnauthorized
+	case containsPhrase(msg, "permission denied", "access denied", "insufficient privilege", "insufficient privileges", "forbidden"):
+		return backend.StatusForbidden
+	case containsPhrase(msg, notFoundPhrases...):
+		return backend.StatusNotFound
+	case containsPhrase(msg, "timeout", "timed out", "deadline exceeded"):
+		return backend.StatusTimeout
+	case containsPhrase(msg, "too many requests", "too many queries", "overloaded", "rate limit exceeded", "quota exceeded"):
+		return backend.StatusTooManyRequests
+	case e.HttpStatus >= 500:
+		return backend.StatusBadGateway
+	default:
+		return backend.StatusBadRequest
+	}
+}
+
+// MissingTable returns the table name of a "table not found" error.
+func (e *CnosdbError) MissingTable() (string, bool) {
+	msg := strings.ToLower(e.Message)
+	if !strings.Contains(msg, "table") || !containsPhrase(msg, notFoundPhrases...) {
+		return "", false
+	}
+	if match := regexpTableName.FindStringSubmatch(e.Message); match != nil {
+		name := match[1]
+		// Strip the database of "db.table"
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			name = name[i+1:]
+		}
+		return name, true
+	}
+	return "", true
+}
+
+func (e *CnosdbError) StatusError() *StatusError {
+	return &StatusError{
+		Status:  e.GrafanaStatus(),
+		Source:  ErrorSourceDownstream,
+		Code:    e.Code,
+		Message: e.Error(),
+	}
+}
+
+// ConnectionError maps an error of the HTTP client to a downstream error.
+func ConnectionError(err error) *StatusError {
+	if isTLSError(err) {
+		return tlsStatusError(err)
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return NewDownstreamError(backend.StatusTimeout, err.Error())
+	}
+	return NewDownstreamError(backend.StatusBadGateway, err.Error())
+}
+
+// containsPhrase returns true if s contains one of phrases delimited by non-word characters.
+func containsPhrase(s string, phrases ...string) bool {
+	for _, phrase := range phrases {
+		for i := strings.Index(s, phrase); i >= 0; {
+			end := i + len(phrase)
+			if (i == 0 || !isIdentChar(s[i-1])) && (end == len(s) || !isIdentChar(s[end])) {
+				return true
+			}
+			next := strings.Index(s[i+1:], phrase)
+			if next < 0 {
+				break
+			}
+			i += 1 + next
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package plugin_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/cnosdb/cnos-cnosdb-datasource-backend/pkg/plugin"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCnosdbErrorGrafanaStatus(t *testing.T) {
+	cases := []struct {
+		httpStatus int
+		message    string
+		expected   backend.Status
+	}{
+		{http.StatusUnauthorized, "", backend.StatusUnauthorized},
+		{http.StatusUnprocessableEntity, "Auth error: password mismatch", backend.StatusUnauthorized},
+		{http.StatusForbidden, "", backend.StatusForbidden},
+		{http.StatusUnprocessableEntity, "table not found: \"public.cpu\"", backend.StatusNotFound},
+		{http.StatusUnprocessableEntity, "database 'db0' not found", backend.StatusNotFound},
+		{http.StatusGatewayTimeout, "", backend.StatusTimeout},
+		{http.StatusUnprocessableEntity, "query timeout", backend.StatusTimeout},
+		{http.StatusTooManyRequests, "", backend.StatusTooManyRequests},
+		{http.StatusServiceUnavailable, "", backend.StatusTooManyRequests},
+		{http.StatusInternalServerError, "", backend.StatusBadGateway},
+		{http.StatusUnprocessableEntity, "syntax error", backend.StatusBadRequest},
+		{http.StatusUnprocessableEntity, "table author not found", backend.StatusNotFound},
+		{http.StatusUnprocessableEntity, "table auth_logs does not exist", backend.StatusNotFound},
+		{http.StatusUnprocessableEntity, "table timeout_events not found", backend.StatusNotFound},
+		{http.StatusUnprocessableEntity, "column quota_limit_exceeded is ambiguous", backend.StatusBadRequest},
+		{http.StatusUnprocessableEntity, "deadline exceeded", backend.StatusTimeout},
+		{http.StatusUnprocessableEntity, "rate limit exceeded", backend.StatusTooManyRequests},
+		{http.StatusNotFound, "auth error", backend.StatusNotFound},
+		{http.StatusInternalServerError, "query timeout", backend.StatusTimeout},
+	}
+	for _, c := range cases {
+		cnosdbErr := &plugin.CnosdbError{HttpStatus: c.httpStatus, Message: c.message}
+		assert.Equal(t, c.expected, cnosdbErr.GrafanaStatus(), "%d %s", c.httpStatus, c.message)
+	}
+}
+
+func TestCnosdbErrorMissingTable(t *testing.T) {
+	table, ok := (&plugin.CnosdbError{Message: "Table not found: \"public.cpu_usag\""}).MissingTable()
+	assert.True(t, ok)
+	assert.Equal(t, "cpu_usag", table)
+
+	table, ok = (&plugin.CnosdbError{Message: "table not found"}).MissingTable()
+	assert.True(t, ok)
+	assert.Equal(t, "", table)
+
+	_, ok = (&plugin.CnosdbError{Message: "database 'db0' not found"}).MissingTable()
+	assert.False(t, ok)
+
+	table, ok = (&plugin.CnosdbError{Message: "Table not found: \"public.author\""}).MissingTable()
+	assert.True(t, ok)
+	assert.Equal(t, "author", table)
+}
+
+func TestConnectionError(t *testing.T) {
+	assert.Equal(t, backend.StatusTimeout, plugin.ConnectionError(context.DeadlineExceeded).Status)
+	err := plugin.ConnectionError(errors.New("connection refused"))
+	assert.Equal(t, backend.StatusBadGateway, err.Status)
+	assert.Equal(t, plugin.ErrorSourceDownstream, err.Source)
+}
@@ -0,0 +1,245 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// HealthCheck is the result of one step of CheckHealth.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// HealthDetails are the JSON details of the CheckHealth result.
+type HealthDetails struct {
+	Version      string          `json:"version,omitempty"`
+	Capabilities *Capabilities   `json:"capabilities,omitempty"`
+	Checks       []HealthCheck   `json:"checks"`
+	Endpoints    []EndpointState `json:"endpoints,omitempty"`
+}
+
+// pingResponse is the response of /api/v1/ping, e.g. {"version":"2.3.0","status":"healthy"}.
+type pingResponse struct {
+	Version string `json:"version"`
+	Status  string `json:"status"`
+}
+
+// parsePingResponse parses the response of a ping request. The rows returned by a query pinging
+// CnosDB cloud, see CnosdbCloudApi.BuildPingRequest, tell that the server is healthy but not its version.
+func parsePingResponse(body []byte) (pingResponse, error) {
+	var ping pingResponse
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var rows []map[string]interface{}
+		if err := json.Unmarshal(trimmed, &rows); err != nil {
+			return ping, err
+		}
+		ping.Status = "healthy"
+		return ping, nil
+	}
+	err := json.Unmarshal(body, &ping)
+	return ping, err
+}
+
+// CheckHealth handles health checks sent from Grafana to the plugin.
+// The main use case for these health checks is the test button on the
+// datasource configuration page which allows users to verify that
+// a datasource is working as expected.
+//
+// CnosDB is pinged first, every endpoint is pinged if there are several. If any endpoint responds,
+// an authenticated SHOW TABLES checks the credentials and the database of the datasource.
+func (d *CnosdbDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	ctx = withForwardedHeaders(ctx, req)
+	details := &HealthDetails{}
+
+	pingOk, err := d.checkPing(ctx, details)
+	if err != nil {
+		return nil, err
+	}
+	if pingOk {
+		if details.Version != "" {
+			d.setVersion(details.Version)
+			caps := CapabilitiesOf(details.Version)
+			details.Capabilities = &caps
+		}
+		d.checkQuery(ctx, req.PluginContext, details)
+	}
+	if d.endpoints != nil && len(d.endpoints.Endpoints()) > 1 {
+		details.Endpoints = d.endpoints.State()
+	}
+
+	jsonDetails, err := json.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	result := &backend.CheckHealthResult{Status: backend.HealthStatusOk, JSONDetails: jsonDetails}
+	for _, check := range details.Checks {
+		if !check.Passed && check.Name != "ping" {
+			result.Status = backend.HealthStatusError
+			result.Message = check.Message
+			if check.Hint != "" {
+				result.Message += fmt.Sprintf(" (%s)", check.Hint)
+			}
+			return result, nil
+		}
+	}
+
+	result.Message = "Data source is working"
+	if details.Version != "" {
+		result.Message += fmt.Sprintf(", CnosDB version %s", details.Version)
+	}
+	if failed := failedChecks(details.Checks); len(failed) > 0 {
+		result.Message += fmt.Sprintf(", %d of %d endpoints failed: %s", len(failed), len(d.endpoints.Endpoints()), strings.Join(failed, "; "))
+	}
+	return result, nil
+}
+
+// checkPing pings all endpoints and adds a "ping" check for each, or a single "ping" check if
+// there is one endpoint. It returns true if any endpoint responded.
+func (d *CnosdbDatasource) checkPing(ctx context.Context, details *HealthDetails) (bool, error) {
+	if d.endpoints == nil || len(d.endpoints.Endpoints()) <= 1 {
+		check, version, err := d.ping(ctx)
+		if err != nil {
+			return false, err
+		}
+		// A single endpoint must respond
+		check.Name = "connection"
+		details.Version = version
+		details.Checks = append(details.Checks, check)
+		return check.Passed, nil
+	}
+
+	anyOk := false
+	for _, ep := range d.endpoints.Endpoints() {
+		check, version, err := d.ping(withEndpoint(ctx, ep))
+		if err != nil {
+			return false, err
+		}
+		if check.Passed {
+			anyOk = true
+			if details.Version == "" {
+				details.Version = version
+			}
+		} else {
+			check.Message = fmt.Sprintf("%s: %s", ep.Url.Host, check.Message)
+		}
+		details.Checks = append(details.Checks, check)
+	}
+	if !anyOk {
+		details.Checks = append(details.Checks, HealthCheck{
+			Name:    "connection",
+			Message: "Ping CnosDB failed: no endpoint responded",
+			Hint:    "check the URLs of the endpoints and that CnosDB is running",
+		})
+	}
+	return anyOk, nil
+}
+
+// ping pings the endpoint selected for ctx and returns the server version.
+func (d *CnosdbDatasource) ping(ctx context.Context) (HealthCheck, string, error) {
+	check := HealthCheck{Name: "ping"}
+	pingReq, err := d.api.BuildPingRequest(ctx, d)
+	if err != nil {
+		return check, "", fmt.Errorf("failed to build ping request: %w", err)
+	}
+
+	res, err := d.client.Do(pingReq)
+	if err != nil {
+		check.Message, check.Hint = pingError(err)
+		return check, "", nil
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		check.Message = "Ping CnosDB not return anything"
+		return check, "", nil
+	}
+	if res.StatusCode/100 != 2 {
+		check.Message = fmt.Sprintf("Ping CnosDB returned error: %s", res.Status)
+		check.Hint = "check that the URL points to CnosDB, including the path prefix of a reverse proxy"
+		return check, "", nil
+	}
+
+	ping, err := parsePingResponse(body)
+	if err != nil {
+		check.Message = "Ping CnosDB returned an unexpected response"
+		check.Hint = "check that the URL points to CnosDB, including the path prefix of a reverse proxy"
+		return check, "", nil
+	}
+	check.Passed = true
+	if ping.Version == "" {
+		check.Message = fmt.Sprintf("CnosDB is %s", ping.Status)
+	} else {
+		check.Message = fmt.Sprintf("CnosDB version %s is %s", ping.Version, ping.Status)
+	}
+	return check, ping.Version, nil
+}
+
+// checkQuery runs SHOW TABLES as the Grafana user of pluginContext.
+func (d *CnosdbDatasource) checkQuery(ctx context.Context, pluginContext backend.PluginContext, details *HealthDetails) {
+	check := HealthCheck{Name: "query"}
+	defer func() {
+		details.Checks = append(details.Checks, check)
+	}()
+
+	ctx, err := d.withQueryTarget(ctx, pluginContext)
+	if err != nil {
+		check.Message = err.Error()
+		check.Hint = "add an identity mapping for this user"
+		return
+	}
+	target := d.queryTarget(ctx)
+
+	frame, err := d.executeStatement(ctx, &QueryModel{}, &backend.DataQuery{}, "SHOW TABLES")
+	if err != nil {
+		check.Message = fmt.Sprintf("Query CnosDB failed: %s", err)
+		switch StatusOf(err) {
+		case backend.StatusUnauthorized:
+			check.Hint = "check the credentials of the datasource"
+		case backend.StatusForbidden:
+			check.Hint = "the user is not allowed to read the database"
+		case backend.StatusNotFound:
+			check.Hint = fmt.Sprintf("check that tenant %q and database %q exist", target.Tenant, target.Database)
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.Hint != "" {
+			check.Hint = statusErr.Hint
+		}
+		return
+	}
+	check.Passed = true
+	check.Message = fmt.Sprintf("%d tables in database %q", frame.Rows(), target.Database)
+}
+
+// pingError describes an error of the ping request and how to fix it.
+func pingError(err error) (string, string) {
+	if isTLSError(err) {
+		return fmt.Sprintf("TLS verification failed: %s", err), tlsErrorHint(err)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Sprintf("Ping CnosDB failed: %s", err), "CnosDB didn't respond in time, check the network and the load of CnosDB"
+	}
+	return fmt.Sprintf("Ping CnosDB failed: %s", err), "check the URL and that CnosDB is running"
+}
+
+func failedChecks(checks []HealthCheck) []string {
+	var failed []string
+	for _, check := range checks {
+		if !check.Passed {
+			failed = append(failed, check.Message)
+		}
+	}
+	return failed
+}
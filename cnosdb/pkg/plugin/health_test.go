@@ -0,0 +1,89 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cnosdb/cnos-cnosdb-datasource-backend/pkg/plugin"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+// cnosdbHandler responds to ping and to SHOW TABLES like CnosDB.
+func cnosdbHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/v1/ping":
+		_, _ = w.Write([]byte(`{"version":"2.3.0","status":"healthy"}`))
+	case "/api/v1/sql":
+		_, _ = w.Write([]byte(`[{"table_name":"cpu"},{"table_name":"mem"}]`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func checkHealthDetails(t *testing.T, res *backend.CheckHealthResult) plugin.HealthDetails {
+	var details plugin.HealthDetails
+	if err := json.Unmarshal(res.JSONDetails, &details); err != nil {
+		t.Fatal(err)
+	}
+	return details
+}
+
+func TestCheckHealth(t *testing.T) {
+	ds := newTestDatasource(t, cnosdbHandler)
+
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, backend.HealthStatusOk, res.Status)
+	assert.Equal(t, "Data source is working, CnosDB version 2.3.0", res.Message)
+
+	details := checkHealthDetails(t, res)
+	assert.Equal(t, "2.3.0", details.Version)
+	assert.Equal(t, &plugin.Capabilities{Version: "2.3.0", DateBin: true, Gapfill: true, QuotedTagKey: true}, details.Capabilities)
+	assert.Equal(t, []plugin.HealthCheck{
+		{Name: "connection", Passed: true, Message: "CnosDB version 2.3.0 is healthy"},
+		{Name: "query", Passed: true, Message: `2 tables in database "public"`},
+	}, details.Checks)
+}
+
+func TestCheckHealthUnauthorized(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/sql" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error_code":"010002","error_message":"Auth error: password mismatch"}`))
+			return
+		}
+		cnosdbHandler(w, r)
+	})
+
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, backend.HealthStatusError, res.Status)
+	assert.Contains(t, res.Message, "Query CnosDB failed")
+	assert.Contains(t, res.Message, "check the credentials of the datasource")
+
+	details := checkHealthDetails(t, res)
+	assert.Len(t, details.Checks, 2)
+	assert.True(t, details.Checks[0].Passed)
+	assert.False(t, details.Checks[1].Passed)
+	assert.Equal(t, "check the credentials of the datasource", details.Checks[1].Hint)
+}
+
+func TestCheckHealthPingFailed(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, backend.HealthStatusError, res.Status)
+	assert.Contains(t, res.Message, "Ping CnosDB returned error: 404 Not Found")
+
+	// The query is not checked if CnosDB is not reachable
+	details := checkHealthDetails(t, res)
+	assert.Len(t, details.Checks, 1)
+	assert.Equal(t, "connection", details.Checks[0].Name)
+	assert.NotEmpty(t, details.Checks[0].Hint)
+}
@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+// IdentityMapping maps Grafana users to a CnosDB tenant, database and credentials. Empty criteria
+// match any user, e.g. a mapping with only OrgID matches every user of the organization. The Grafana
+// SDK doesn't send the teams of a user to plugins, so users are matched by organization, login or
+// email, and role.
+type IdentityMapping struct {
+	OrgID int64  `json:"orgId,omitempty"`
+	Login string `json:"login,omitempty"`
+	Role  string `json:"role,omitempty"`
+
+	Tenant   string `json:"tenant,omitempty"`
+	Database string `json:"database,omitempty"`
+	// BasicAuthUser is the CnosDB user of the mapped Grafana users, its password is stored in the
+	// secure JSON data as "basicAuthPassword.<BasicAuthUser>".
+	BasicAuthUser string `json:"basicAuthUser,omitempty"`
+	// AllowedDatabases and AllowedTenants are the overrides queries of the mapped users may choose,
+	// they replace the allowed overrides of the datasource, so that users stay on their target.
+	AllowedDatabases []string `json:"allowedDatabases,omitempty"`
+	AllowedTenants   []string `json:"allowedTenants,omitempty"`
+}
+
+// matches returns true if the Grafana user of pluginContext matches the criteria of m.
+func (m *IdentityMapping) matches(pluginContext backend.PluginContext) bool {
+	if m.OrgID != 0 && m.OrgID != pluginContext.OrgID {
+		return false
+	}
+	user := pluginContext.User
+	if m.Login != "" && (user == nil || (!strings.EqualFold(m.Login, user.Login) && !strings.EqualFold(m.Login, user.Email))) {
+		return false
+	}
+	if m.Role != "" && (user == nil || !strings.EqualFold(m.Role, user.Role)) {
+		return false
+	}
+	return true
+}
+
+// QueryTarget is where and as whom a query is run.
+type QueryTarget struct {
+	Tenant    string
+	Database  string
+	BasicAuth *httpclient.BasicAuthOptions
+
+	// mapped is true if the target was resolved by an identity mapping, whose allowed overrides
+	// apply instead of the ones of the datasource
+	mapped           bool
+	allowedDatabases []string
+	allowedTenants   []string
+}
+
+// defaultQueryTarget returns the target of the datasource.
+func (d *CnosdbDatasource) defaultQueryTarget() *QueryTarget {
+	return &QueryTarget{
+		Tenant:           d.options.Tenant,
+		Database:         d.options.Database,
+		BasicAuth:        d.httpOptions.BasicAuth,
+		allowedDatabases: d.options.AllowedDatabases,
+		allowedTenants:   d.options.AllowedTenants,
+	}
+}
+
+type queryTargetKey struct{}
+
+// withQueryTarget resolves the query target of the Grafana user of pluginContext by the identity
+// mappings of the datasource, the first matching mapping wins. If mappings are configured, users
+// without a matching mapping are rejected, so that they don't fall back to the datasource tenant.
+func (d *CnosdbDatasource) withQueryTarget(ctx context.Context, pluginContext backend.PluginContext) (context.Context, error) {
+	target := d.defaultQueryTarget()
+	if len(d.options.IdentityMappings) > 0 {
+		mapping := d.findIdentityMapping(pluginContext)
+		if mapping == nil {
+			login := ""
+			if pluginContext.User != nil {
+				login = pluginContext.User.Login
+			}
+			return ctx, NewStatusError(backend.StatusForbidden, fmt.Sprintf("no CnosDB tenant is mapped to user %q of organization %d", login, pluginContext.OrgID))
+		}
+		if mapping.Tenant != "" {
+			target.Tenant = mapping.Tenant
+		}
+		if mapping.Database != "" {
+			target.Database = mapping.Database
+		}
+		if mapping.BasicAuthUser != "" {
+			target.BasicAuth = &httpclient.BasicAuthOptions{
+				User:     mapping.BasicAuthUser,
+				Password: d.secureJsonData["basicAuthPassword."+mapping.BasicAuthUser],
+			}
+		}
+		target.mapped = true
+		target.allowedDatabases = mapping.AllowedDatabases
+		target.allowedTenants = mapping.AllowedTenants
+	}
+	return context.WithValue(ctx, queryTargetKey{}, target), nil
+}
+
+func (d *CnosdbDatasource) findIdentityMapping(pluginContext backend.PluginContext) *IdentityMapping {
+	for i := range d.options.IdentityMappings {
+		if d.options.IdentityMappings[i].matches(pluginContext) {
+			return &d.options.IdentityMappings[i]
+		}
+	}
+	return nil
+}
+
+// queryTarget returns the query target resolved for the request of ctx, or the target of the datasource.
+func (d *CnosdbDatasource) queryTarget(ctx context.Context) *QueryTarget {
+	if target, ok := ctx.Value(queryTargetKey{}).(*QueryTarget); ok {
+		return target
+	}
+	return d.defaultQueryTarget()
+}
+
+// queryModelTarget returns the query target of ctx with the database and tenant overridden by the
+// query, the overrides must be allowed by AllowedDatabases and AllowedTenants of the identity mapping
+// of the user, or of the datasource if no mapping is configured.
+func (d *CnosdbDatasource) queryModelTarget(ctx context.Context, queryModel *QueryModel) (*QueryTarget, error) {
+	target := d.queryTarget(ctx)
+	overridden := *target
+	if queryModel.Database != "" && queryModel.Database != target.Database {
+		if err := target.checkOverride("database", queryModel.Database, target.allowedDatabases); err != nil {
+			return nil, err
+		}
+		overridden.Database = queryModel.Database
+	}
+	if queryModel.Tenant != "" && queryModel.Tenant != target.Tenant {
+		if err := target.checkOverride("tenant", queryModel.Tenant, target.allowedTenants); err != nil {
+			return nil, err
+		}
+		overridden.Tenant = queryModel.Tenant
+	}
+	return &overridden, nil
+}
+
+func (target *QueryTarget) checkOverride(kind string, value string, allowed []string) error {
+	if len(allowed) == 0 {
+		if target.mapped {
+			return NewStatusError(backend.StatusForbidden, fmt.Sprintf("the identity mapping of the user doesn't allow queries to override the %s", kind))
+		}
+		return NewStatusError(backend.StatusForbidden, fmt.Sprintf("the datasource doesn't allow queries to override the %s", kind))
+	}
+	for _, a := range allowed {
+		if strings.TrimSpace(a) == value {
+			return nil
+		}
+	}
+	return NewStatusError(backend.StatusForbidden, fmt.Sprintf("%s %q is not allowed, allowed values are: %s", kind, value, strings.Join(allowed, ", ")))
+}
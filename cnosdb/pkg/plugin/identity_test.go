@@ -0,0 +1,183 @@
+package plugin_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryDataIdentityMapping(t *testing.T) {
+	var tenant, database, user string
+	ds := newTestDatasourceWithOptions(t, func(w http.ResponseWriter, r *http.Request) {
+		tenant = r.URL.Query().Get("tenant")
+		database = r.URL.Query().Get("db")
+		user, _, _ = r.BasicAuth()
+		_, _ = w.Write([]byte(`[]`))
+	}, map[string]interface{}{
+		"tenant": "cnosdb",
+		"identityMappings": []map[string]interface{}{
+			{"orgId": 2, "login": "alice@example.com", "tenant": "team_a", "database": "metrics", "basicAuthUser": "alice"},
+			{"orgId": 2, "role": "Viewer", "tenant": "team_a", "database": "public"},
+			{"orgId": 3, "tenant": "team_b"},
+		},
+	})
+
+	cases := []struct {
+		pluginContext backend.PluginContext
+		status        backend.Status
+		tenant        string
+		database      string
+		user          string
+	}{
+		{
+			pluginContext: backend.PluginContext{OrgID: 2, User: &backend.User{Login: "alice", Email: "alice@example.com", Role: "Editor"}},
+			tenant:        "team_a",
+			database:      "metrics",
+			user:          "alice",
+		},
+		{
+			pluginContext: backend.PluginContext{OrgID: 2, User: &backend.User{Login: "bob", Role: "Viewer"}},
+			tenant:        "team_a",
+			database:      "public",
+		},
+		{
+			pluginContext: backend.PluginContext{OrgID: 3, User: &backend.User{Login: "carol", Role: "Admin"}},
+			tenant:        "team_b",
+			database:      "public",
+		},
+		{
+			pluginContext: backend.PluginContext{OrgID: 2, User: &backend.User{Login: "dave", Role: "Editor"}},
+			status:        backend.StatusForbidden,
+		},
+	}
+	for _, c := range cases {
+		tenant, database, user = "", "", ""
+		resp, err := ds.QueryData(
+			context.Background(),
+			&backend.QueryDataRequest{
+				PluginContext: c.pluginContext,
+				Queries: []backend.DataQuery{{
+					RefID: "A",
+					JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT 1"}`),
+				}},
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := resp.Responses["A"]
+		if c.status != 0 {
+			assert.Equal(t, c.status, res.Status)
+			continue
+		}
+		assert.NoError(t, res.Error)
+		assert.Equal(t, c.tenant, tenant, c.pluginContext.User.Login)
+		assert.Equal(t, c.database, database, c.pluginContext.User.Login)
+		assert.Equal(t, c.user, user, c.pluginContext.User.Login)
+	}
+}
+
+func TestQueryDataTargetOverride(t *testing.T) {
+	var tenant, database string
+	ds := newTestDatasourceWithOptions(t, func(w http.ResponseWriter, r *http.Request) {
+		tenant = r.URL.Query().Get("tenant")
+		database = r.URL.Query().Get("db")
+		_, _ = w.Write([]byte(`[]`))
+	}, map[string]interface{}{
+		"tenant":           "cnosdb",
+		"allowedDatabases": []string{"public", "metrics"},
+		"allowedTenants":   []string{"team_a"},
+	})
+
+	cases := []struct {
+		query    string
+		status   backend.Status
+		tenant   string
+		database string
+	}{
+		{query: `{"rawQuery":true,"queryText":"SHOW TABLES"}`, tenant: "cnosdb", database: "public"},
+		{query: `{"rawQuery":true,"queryText":"SHOW TABLES","database":"metrics"}`, tenant: "cnosdb", database: "metrics"},
+		{query: `{"rawQuery":true,"queryText":"SHOW TABLES","database":"metrics","tenant":"team_a"}`, tenant: "team_a", database: "metrics"},
+		{query: `{"rawQuery":true,"queryText":"SHOW TABLES","database":"secret"}`, status: backend.StatusForbidden},
+		{query: `{"rawQuery":true,"queryText":"SHOW TABLES","tenant":"team_b"}`, status: backend.StatusForbidden},
+	}
+	for _, c := range cases {
+		tenant, database = "", ""
+		resp, err := ds.QueryData(
+			context.Background(),
+			&backend.QueryDataRequest{Queries: []backend.DataQuery{{RefID: "A", JSON: []byte(c.query)}}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := resp.Responses["A"]
+		if c.status != 0 {
+			assert.Equal(t, c.status, res.Status, c.query)
+			assert.Empty(t, database, c.query)
+			continue
+		}
+		assert.NoError(t, res.Error, c.query)
+		assert.Equal(t, c.tenant, tenant, c.query)
+		assert.Equal(t, c.database, database, c.query)
+	}
+}
+
+func TestQueryDataMappedTargetOverride(t *testing.T) {
+	var tenant, database string
+	ds := newTestDatasourceWithOptions(t, func(w http.ResponseWriter, r *http.Request) {
+		tenant = r.URL.Query().Get("tenant")
+		database = r.URL.Query().Get("db")
+		_, _ = w.Write([]byte(`[]`))
+	}, map[string]interface{}{
+		"tenant":           "cnosdb",
+		"allowedDatabases": []string{"public", "metrics"},
+		"allowedTenants":   []string{"team_a", "team_b"},
+		"identityMappings": []map[string]interface{}{
+			{"login": "alice", "tenant": "team_a", "allowedDatabases": []string{"metrics"}},
+			{"login": "bob", "tenant": "team_b"},
+		},
+	})
+
+	cases := []struct {
+		login    string
+		query    string
+		status   backend.Status
+		tenant   string
+		database string
+	}{
+		{login: "alice", query: `{"rawQuery":true,"queryText":"SHOW TABLES","database":"metrics"}`, tenant: "team_a", database: "metrics"},
+		// The datasource allows team_b, but alice is pinned to team_a by her mapping
+		{login: "alice", query: `{"rawQuery":true,"queryText":"SHOW TABLES","tenant":"team_b"}`, status: backend.StatusForbidden},
+		{login: "bob", query: `{"rawQuery":true,"queryText":"SHOW TABLES","tenant":"team_a"}`, status: backend.StatusForbidden},
+		{login: "bob", query: `{"rawQuery":true,"queryText":"SHOW TABLES","database":"metrics"}`, status: backend.StatusForbidden},
+		{login: "bob", query: `{"rawQuery":true,"queryText":"SHOW TABLES","tenant":"team_b"}`, tenant: "team_b", database: "public"},
+	}
+	for _, c := range cases {
+		tenant, database = "", ""
+		resp, err := ds.QueryData(
+			context.Background(),
+			&backend.QueryDataRequest{
+				PluginContext: backend.PluginContext{User: &backend.User{Login: c.login}},
+				Queries:       []backend.DataQuery{{RefID: "A", JSON: []byte(c.query)}},
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := resp.Responses["A"]
+		if c.status != 0 {
+			assert.Equal(t, c.status, res.Status, c.query)
+			assert.Empty(t, tenant, c.query)
+			continue
+		}
+		assert.NoError(t, res.Error, c.query)
+		assert.Equal(t, c.tenant, tenant, c.query)
+		assert.Equal(t, c.database, database, c.query)
+	}
+}
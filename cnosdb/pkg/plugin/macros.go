@@ -0,0 +1,417 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+)
+
+// DefaultScrapeInterval is the assumed interval between two samples, used by $__rate_interval.
+const DefaultScrapeInterval = 15 * time.Second
+
+var macros map[string]MacroFunc
+
+// MacroFunc expands a macro to SQL. args is nil if the macro is used without parentheses,
+// e.g. `$__interval`, and an empty slice for `$__timeFrom()`.
+type MacroFunc func(mc *MacroContext, args []string) (string, error)
+
+// MacroContext holds the values the macros of one query are expanded with.
+type MacroContext struct {
+	Query     *QueryModel
+	TimeRange backend.TimeRange
+	Interval  time.Duration
+}
+
+func init() {
+	macros = make(map[string]MacroFunc)
+
+	macros["timeFilter"] = timeFilterMacro
+	macros["__timeFilter"] = timeFilterMacro
+	macros["__timeFrom"] = timeFromMacro
+	macros["__timeTo"] = timeToMacro
+	macros["__timeGroup"] = timeGroupMacro
+	macros["__timeGroupAlias"] = timeGroupAliasMacro
+	macros["__unixEpochFilter"] = unixEpochFilterMacro
+	macros["__unixEpochGroup"] = unixEpochGroupMacro
+	macros["__unixEpochGroupAlias"] = unixEpochGroupAliasMacro
+	macros["__interval"] = intervalMacro
+	macros["__interval_ms"] = intervalMsMacro
+	macros["__rate_interval"] = rateIntervalMacro
+	macros["__range"] = rangeMacro
+	macros["__range_ms"] = rangeMsMacro
+	macros["__range_s"] = rangeSecondsMacro
+}
+
+// ExpandMacros replaces every macro in sql, e.g. `$__timeFilter(time)` or `${__interval}`.
+// Unknown variables are kept as they are, unknown macros called with arguments are errors.
+// Quoted strings and identifiers are text, only macros without arguments are expanded in them,
+// e.g. `INTERVAL '$__interval'`, so that e.g. a tag value '$__foo(' is kept as it is.
+func ExpandMacros(mc *MacroContext, sql string) (string, error) {
+	var sb strings.Builder
+	var quote byte
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		if c != '$' {
+			if quote != 0 && c == quote {
+				quote = 0
+			} else if quote == 0 && (c == '\'' || c == '"') {
+				quote = c
+			}
+			sb.WriteByte(c)
+			i++
+			continue
+		}
+
+		name, end, braced := scanMacroName(sql, i+1)
+		hasArgs := !braced && end < len(sql) && sql[end] == '('
+		macro, exists := macros[name]
+		if quote != 0 && hasArgs {
+			exists = false
+			hasArgs = false
+		}
+		if !exists {
+			if hasArgs && strings.HasPrefix(name, "__") {
+				return "", fmt.Errorf("undefined macro: $%s", name)
+			}
+			sb.WriteByte('$')
+			i++
+			continue
+		}
+
+		var args []string
+		if hasArgs {
+			closing, err := findClosingParen(sql, end)
+			if err != nil {
+				return "", fmt.Errorf("macro $%s: %w", name, err)
+			}
+			args = splitMacroArgs(sql[end+1 : closing])
+			for j, arg := range args {
+				if args[j], err = ExpandMacros(mc, arg); err != nil {
+					return "", err
+				}
+			}
+			end = closing + 1
+		}
+
+		res, err := macro(mc, args)
+		if err != nil {
+			return "", fmt.Errorf("macro $%s: %w", name, err)
+		}
+		sb.WriteString(res)
+		i = end
+	}
+
+	return sb.String(), nil
+}
+
+// scanMacroName reads the identifier starting at sql[start], with optional braces.
+// It returns the identifier, the position after it and whether it was braced.
+func scanMacroName(sql string, start int) (string, int, bool) {
+	braced := start < len(sql) && sql[start] == '{'
+	i := start
+	if braced {
+		i++
+	}
+	nameStart := i
+	for i < len(sql) && isIdentChar(sql[i]) {
+		i++
+	}
+	name := sql[nameStart:i]
+	if braced {
+		if i >= len(sql) || sql[i] != '}' {
+			return "", start, false
+		}
+		i++
+	}
+	return name, i, braced
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// findClosingParen returns the position of the parenthesis matching the one at sql[open],
+// skipping quoted strings.
+func findClosingParen(sql string, open int) (int, error) {
+	depth := 0
+	var quote byte
+	for i := open; i < len(sql); i++ {
+		c := sql[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"':
+			quote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, errors.New("missing closing parenthesis")
+}
+
+// splitMacroArgs splits the text between the parentheses of a macro by top-level commas.
+func splitMacroArgs(text string) []string {
+	args := make([]string, 0)
+	if strings.TrimSpace(text) == "" {
+		return args
+	}
+
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"':
+			quote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(text[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(args, strings.TrimSpace(text[start:]))
+}
+
+func checkMacroArgs(args []string, min int, max int) error {
+	if len(args) >= min && len(args) <= max {
+		return nil
+	}
+	if min == max {
+		return fmt.Errorf("expected %d argument(s), got %d", min, len(args))
+	}
+	return fmt.Errorf("expected %d to %d arguments, got %d", min, max, len(args))
+}
+
+// ParseMacroInterval parses an interval argument of a macro, either as
+// a CnosDB interval ('10 minutes') or as a Grafana duration ('10m').
+func ParseMacroInterval(arg string) (time.Duration, error) {
+	str := strings.Trim(strings.TrimSpace(arg), `'`)
+	if interval := ParseIntervalString(str); interval > 0 {
+		return interval, nil
+	}
+	interval, err := gtime.ParseDuration(str)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid interval %q", arg)
+	}
+	return interval, nil
+}
+
+// FormatIntervalString formats an interval as a CnosDB interval string, e.g. "10 minutes".
+func FormatIntervalString(interval time.Duration) string {
+	units := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+		{"second", time.Second},
+		{"millisecond", time.Millisecond},
+	}
+
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	interval = interval.Round(time.Millisecond)
+	for _, unit := range units {
+		if interval%unit.duration == 0 {
+			num := int64(interval / unit.duration)
+			if num == 1 {
+				return fmt.Sprintf("1 %s", unit.name)
+			}
+			return fmt.Sprintf("%d %ss", num, unit.name)
+		}
+	}
+	return ""
+}
+
+func parseFillArg(arg string) (string, error) {
+	fill := strings.Trim(strings.TrimSpace(arg), `'`)
+	switch strings.ToLower(fill) {
+	case FillPrevious, FillNull:
+		return strings.ToLower(fill), nil
+	}
+	if _, err := strconv.ParseFloat(fill, 64); err != nil {
+		return "", fmt.Errorf("invalid fill value %q", arg)
+	}
+	return fill, nil
+}
+
+func (mc *MacroContext) requireInterval() (time.Duration, error) {
+	if mc.Interval <= 0 {
+		return 0, errors.New("interval is not set")
+	}
+	return mc.Interval, nil
+}
+
+func timeFilterMacro(mc *MacroContext, args []string) (string, error) {
+	column := ColumnTime
+	if args != nil {
+		if err := checkMacroArgs(args, 1, 1); err != nil {
+			return "", err
+		}
+		column = args[0]
+	}
+	return fmt.Sprintf("%s >= %d AND %s <= %d", column, mc.TimeRange.From.UnixNano(), column, mc.TimeRange.To.UnixNano()), nil
+}
+
+func timeFromMacro(mc *MacroContext, args []string) (string, error) {
+	if err := checkMacroArgs(args, 0, 0); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("TIMESTAMP '%s'", mc.TimeRange.From.UTC().Format(time.RFC3339Nano)), nil
+}
+
+func timeToMacro(mc *MacroContext, args []string) (string, error) {
+	if err := checkMacroArgs(args, 0, 0); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("TIMESTAMP '%s'", mc.TimeRange.To.UTC().Format(time.RFC3339Nano)), nil
+}
+
+// parseGroupArgs parses the (column, interval[, fill]) arguments of the group macros,
+// the fill mode is applied to the query so that the response is resampled.
+func parseGroupArgs(mc *MacroContext, args []string) (string, time.Duration, error) {
+	if err := checkMacroArgs(args, 2, 3); err != nil {
+		return "", 0, err
+	}
+	interval, err := ParseMacroInterval(args[1])
+	if err != nil {
+		return "", 0, err
+	}
+	if len(args) == 3 {
+		fill, err := parseFillArg(args[2])
+		if err != nil {
+			return "", 0, err
+		}
+		mc.Query.Fill = fill
+		mc.Query.Interval = FormatIntervalString(interval)
+	}
+	return args[0], interval, nil
+}
+
+func timeGroupMacro(mc *MacroContext, args []string) (string, error) {
+	column, interval, err := parseGroupArgs(mc, args)
+	if err != nil {
+		return "", err
+	}
+	return mc.Query.Capabilities().timeBucket(FormatIntervalString(interval), column)
+}
+
+func timeGroupAliasMacro(mc *MacroContext, args []string) (string, error) {
+	res, err := timeGroupMacro(mc, args)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`%s AS "%s"`, res, ColumnTime), nil
+}
+
+func unixEpochFilterMacro(mc *MacroContext, args []string) (string, error) {
+	if err := checkMacroArgs(args, 1, 1); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s >= %d AND %s <= %d", args[0], mc.TimeRange.From.Unix(), args[0], mc.TimeRange.To.Unix()), nil
+}
+
+func unixEpochGroupMacro(mc *MacroContext, args []string) (string, error) {
+	column, interval, err := parseGroupArgs(mc, args)
+	if err != nil {
+		return "", err
+	}
+	seconds := int64(math.Max(interval.Seconds(), 1))
+	return fmt.Sprintf("FLOOR(%s / %d) * %d", column, seconds, seconds), nil
+}
+
+func unixEpochGroupAliasMacro(mc *MacroContext, args []string) (string, error) {
+	res, err := unixEpochGroupMacro(mc, args)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`%s AS "%s"`, res, ColumnTime), nil
+}
+
+func intervalMacro(mc *MacroContext, args []string) (string, error) {
+	if args != nil {
+		return "", errors.New("does not take arguments")
+	}
+	interval, err := mc.requireInterval()
+	if err != nil {
+		return "", err
+	}
+	return FormatIntervalString(interval), nil
+}
+
+func intervalMsMacro(mc *MacroContext, args []string) (string, error) {
+	if args != nil {
+		return "", errors.New("does not take arguments")
+	}
+	interval, err := mc.requireInterval()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(interval.Milliseconds(), 10), nil
+}
+
+// rateIntervalMacro follows Grafana's definition: max($__interval + scrape interval, 4 * scrape interval).
+func rateIntervalMacro(mc *MacroContext, args []string) (string, error) {
+	if args != nil {
+		return "", errors.New("does not take arguments")
+	}
+	interval, err := mc.requireInterval()
+	if err != nil {
+		return "", err
+	}
+	rateInterval := interval + DefaultScrapeInterval
+	if rateInterval < 4*DefaultScrapeInterval {
+		rateInterval = 4 * DefaultScrapeInterval
+	}
+	return FormatIntervalString(rateInterval), nil
+}
+
+func rangeMacro(mc *MacroContext, args []string) (string, error) {
+	if args != nil {
+		return "", errors.New("does not take arguments")
+	}
+	return FormatIntervalString(mc.TimeRange.Duration()), nil
+}
+
+func rangeMsMacro(mc *MacroContext, args []string) (string, error) {
+	if args != nil {
+		return "", errors.New("does not take arguments")
+	}
+	return strconv.FormatInt(mc.TimeRange.Duration().Milliseconds(), 10), nil
+}
+
+func rangeSecondsMacro(mc *MacroContext, args []string) (string, error) {
+	if args != nil {
+		return "", errors.New("does not take arguments")
+	}
+	return strconv.FormatInt(int64(mc.TimeRange.Duration().Seconds()), 10), nil
+}
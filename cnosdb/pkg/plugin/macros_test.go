@@ -0,0 +1,164 @@
+package plugin_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cnosdb/cnos-cnosdb-datasource-backend/pkg/plugin"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandMacros(t *testing.T) {
+	timeRange := backend.TimeRange{
+		From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name     string
+		sql      string
+		interval time.Duration
+		expected string
+	}{
+		{
+			name:     "legacy time filter",
+			sql:      "SELECT * FROM t WHERE $timeFilter",
+			expected: "SELECT * FROM t WHERE time >= 1665360000000000000 AND time <= 1665964800000000000",
+		},
+		{
+			name:     "braced time filter",
+			sql:      "SELECT * FROM t WHERE ${__timeFilter}",
+			expected: "SELECT * FROM t WHERE time >= 1665360000000000000 AND time <= 1665964800000000000",
+		},
+		{
+			name:     "time filter with column",
+			sql:      "SELECT * FROM t WHERE $__timeFilter(ts)",
+			expected: "SELECT * FROM t WHERE ts >= 1665360000000000000 AND ts <= 1665964800000000000",
+		},
+		{
+			name:     "time from and to",
+			sql:      "SELECT $__timeFrom(), $__timeTo()",
+			expected: "SELECT TIMESTAMP '2022-10-10T00:00:00Z', TIMESTAMP '2022-10-17T00:00:00Z'",
+		},
+		{
+			name:     "time group with grafana duration",
+			sql:      "SELECT $__timeGroup(time, '5m'), avg(v) FROM t",
+			expected: "SELECT DATE_BIN(INTERVAL '5 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z'), avg(v) FROM t",
+		},
+		{
+			name:     "time group alias with interval",
+			sql:      "SELECT $__timeGroupAlias(time, $__interval) FROM t",
+			interval: 10 * time.Second,
+			expected: `SELECT DATE_BIN(INTERVAL '10 seconds', time, TIMESTAMP '1970-01-01T00:00:00Z') AS "time" FROM t`,
+		},
+		{
+			name:     "interval",
+			sql:      "INTERVAL '$__interval' $__interval_ms ${__interval}",
+			interval: time.Minute,
+			expected: "INTERVAL '1 minute' 60000 1 minute",
+		},
+		{
+			name:     "rate interval",
+			sql:      "$__rate_interval",
+			interval: 30 * time.Second,
+			expected: "1 minute",
+		},
+		{
+			name:     "range",
+			sql:      "$__range $__range_ms $__range_s",
+			expected: "7 days 604800000 604800",
+		},
+		{
+			name:     "unix epoch filter",
+			sql:      "WHERE $__unixEpochFilter(ts)",
+			expected: "WHERE ts >= 1665360000 AND ts <= 1665964800",
+		},
+		{
+			name:     "unix epoch group",
+			sql:      "SELECT $__unixEpochGroup(ts, '1h'), $__unixEpochGroupAlias(ts, '10 minutes')",
+			expected: `SELECT FLOOR(ts / 3600) * 3600, FLOOR(ts / 600) * 600 AS "time"`,
+		},
+		{
+			name:     "unknown variable",
+			sql:      "SELECT '$foo', $__bar",
+			expected: "SELECT '$foo', $__bar",
+		},
+		{
+			name:     "macro calls in quotes",
+			sql:      `SELECT * FROM t WHERE "host" = '$__foo(' AND "$__timeFilter(time)" = 'it''s $__interval(1)' AND $__timeFilter`,
+			expected: `SELECT * FROM t WHERE "host" = '$__foo(' AND "$__timeFilter(time)" = 'it''s $__interval(1)' AND time >= 1665360000000000000 AND time <= 1665964800000000000`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc := &plugin.MacroContext{Query: &plugin.QueryModel{}, TimeRange: timeRange, Interval: tt.interval}
+			sql, err := plugin.ExpandMacros(mc, tt.sql)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, sql)
+		})
+	}
+}
+
+func TestExpandMacrosErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected string
+	}{
+		{
+			name:     "undefined macro",
+			sql:      "SELECT $__foo(time)",
+			expected: "undefined macro: $__foo",
+		},
+		{
+			name:     "missing closing parenthesis",
+			sql:      "SELECT $__timeGroup(time, '5m' FROM t",
+			expected: "macro $__timeGroup: missing closing parenthesis",
+		},
+		{
+			name:     "missing arguments",
+			sql:      "SELECT $__timeGroup(time)",
+			expected: "macro $__timeGroup: expected 2 to 3 arguments, got 1",
+		},
+		{
+			name:     "invalid interval",
+			sql:      "SELECT $__timeGroup(time, 'soon')",
+			expected: `macro $__timeGroup: invalid interval "'soon'"`,
+		},
+		{
+			name:     "invalid fill",
+			sql:      "SELECT $__timeGroup(time, '5m', linear)",
+			expected: `macro $__timeGroup: invalid fill value "linear"`,
+		},
+		{
+			name:     "interval not set",
+			sql:      "SELECT $__interval_ms",
+			expected: "macro $__interval_ms: interval is not set",
+		},
+		{
+			name:     "unexpected arguments",
+			sql:      "SELECT $__timeFrom(time)",
+			expected: "macro $__timeFrom: expected 0 argument(s), got 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc := &plugin.MacroContext{Query: &plugin.QueryModel{}}
+			_, err := plugin.ExpandMacros(mc, tt.sql)
+			assert.EqualError(t, err, tt.expected)
+		})
+	}
+}
+
+func TestTimeGroupMacroFill(t *testing.T) {
+	query := &plugin.QueryModel{}
+	mc := &plugin.MacroContext{Query: query}
+	sql, err := plugin.ExpandMacros(mc, "SELECT $__timeGroup(time, '1m', previous)")
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT DATE_BIN(INTERVAL '1 minute', time, TIMESTAMP '1970-01-01T00:00:00Z')", sql)
+	assert.Equal(t, "previous", query.Fill)
+	assert.Equal(t, "1 minute", query.Interval)
+}
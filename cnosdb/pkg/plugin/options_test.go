@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildCnosdbUrl(t *testing.T) {
+	cases := []struct {
+		options  CnosdbDataSourceOptions
+		expected string
+	}{
+		{CnosdbDataSourceOptions{Host: "localhost", Port: 8902}, "http://localhost:8902"},
+		{CnosdbDataSourceOptions{Host: "localhost", Port: 8902, EnableHttps: true}, "https://localhost:8902"},
+		{CnosdbDataSourceOptions{Host: "::1", Port: 8902}, "http://[::1]:8902"},
+		{CnosdbDataSourceOptions{Host: "[fe80::1]", Port: 8902}, "http://[fe80::1]:8902"},
+		{CnosdbDataSourceOptions{Host: "::1"}, "http://[::1]"},
+		{CnosdbDataSourceOptions{Url: "https://gw.example.com/cnosdb/"}, "https://gw.example.com/cnosdb"},
+		{CnosdbDataSourceOptions{Url: "http://[::1]:8902"}, "http://[::1]:8902"},
+		{CnosdbDataSourceOptions{Url: "localhost:8902", Host: "ignored", Port: 1}, "http://localhost:8902"},
+	}
+	for _, c := range cases {
+		u, err := c.options.buildCnosdbUrl()
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, u.String())
+	}
+
+	for _, options := range []CnosdbDataSourceOptions{{}, {Url: "ftp://localhost"}, {Url: "http:///cnosdb"}} {
+		_, err := options.buildCnosdbUrl()
+		assert.Error(t, err)
+	}
+}
+
+func TestBuildCnosdbUrlPathPrefix(t *testing.T) {
+	api, err := NewCnosdbApi(&CnosdbDataSourceOptions{Url: "https://gw.example.com/cnosdb/"})
+	assert.NoError(t, err)
+	req, err := api.BuildQueryRequest(context.Background(), &CnosdbDatasource{}, &QueryTarget{Database: "public"}, "SELECT 1")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://gw.example.com/cnosdb/api/v1/sql?db=public", req.URL.String())
+
+	req, err = api.BuildPingRequest(context.Background(), &CnosdbDatasource{})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://gw.example.com/cnosdb/api/v1/ping", req.URL.String())
+}
+
+func TestBuildEndpointUrls(t *testing.T) {
+	options := CnosdbDataSourceOptions{
+		Url:       "https://node1:8902/cnosdb",
+		Endpoints: []string{"node2:8902", " ", "https://[::2]:8902"},
+	}
+	urls, err := options.buildEndpointUrls()
+	assert.NoError(t, err)
+	assert.Len(t, urls, 3)
+	assert.Equal(t, "https://node2:8902", urls[1].String())
+	assert.Equal(t, "[::2]:8902", urls[2].Host)
+
+	options.Endpoints = []string{"node2:8902/"}
+	_, err = options.buildEndpointUrls()
+	assert.NoError(t, err)
+
+	options.Endpoints = []string{"https://node2:8902/other"}
+	_, err = options.buildEndpointUrls()
+	assert.EqualError(t, err, `invalid endpoint "https://node2:8902/other": endpoints share the path of the URL "https://node1:8902/cnosdb"`)
+}
+
+func TestCloudApiKey(t *testing.T) {
+	options := CnosdbDataSourceOptions{Url: "https://cloud.example.com", ApiKey: "legacy"}
+	assert.Equal(t, "secret", options.apiKey(map[string]string{"apiKey": "secret"}))
+	assert.Equal(t, "legacy", options.apiKey(nil))
+
+	api, err := NewCnosdbCloudApi(&options, "secret")
+	assert.NoError(t, err)
+	req, err := api.BuildQueryRequest(context.Background(), &CnosdbDatasource{}, &QueryTarget{}, "SELECT 1")
+	assert.NoError(t, err)
+	assert.Empty(t, req.URL.Query().Get("apikey"))
+	body, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"apikey":"secret","database":"","sql":"SELECT 1"}`, string(body))
+
+	// The cloud is pinged by a query, so that the API key isn't sent in the URL
+	d := &CnosdbDatasource{options: CnosdbDataSourceOptions{Database: "db"}}
+	req, err = api.BuildPingRequest(context.Background(), d)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://cloud.example.com/api/v1/sql", req.URL.String())
+	body, err = io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"apikey":"secret","database":"db","sql":"SELECT 1"}`, string(body))
+}
+
+func TestParsePingResponse(t *testing.T) {
+	ping, err := parsePingResponse([]byte(`{"version":"2.3.0","status":"healthy"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, pingResponse{Version: "2.3.0", Status: "healthy"}, ping)
+
+	// The rows of the query pinging CnosDB cloud
+	ping, err = parsePingResponse([]byte(` [{"Int64(1)":1}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, pingResponse{Status: "healthy"}, ping)
+
+	_, err = parsePingResponse([]byte(`<html>`))
+	assert.Error(t, err)
+}
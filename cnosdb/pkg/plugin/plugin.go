@@ -1,16 +1,17 @@
 package plugin
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -45,6 +46,9 @@ const (
 
 	FillPrevious = "previous"
 	FillNull     = "null"
+
+	// MaxConcurrentStatements bounds the statements of a query run at the same time
+	MaxConcurrentStatements = 4
 )
 
 type CnosdbMode int
@@ -55,27 +59,207 @@ const (
 )
 
 type CnosdbDataSourceOptions struct {
-	Host                  string     `json:"host"`
-	Port                  int        `json:"port"`
-	Database              string     `json:"database"`
-	CnosdbMode            CnosdbMode `json:"cnosdbMode"`
-	Tenant                string     `json:"tenant"`
-	ApiKey                string     `json:"apiKey"`
-	EnableHttps           bool       `json:"enableHttps"`
-	CaCert                string     `json:"caCert"`
-	TargetPartitions      int        `json:"targetPartitions"`
-	StreamTriggerInterval string     `json:"streamTriggerInterval"`
-	UseChunkedResponse    bool       `json:"useChunkedResponse"`
+	Url                   string            `json:"url"`
+	Host                  string            `json:"host"`
+	Port                  int               `json:"port"`
+	Database              string            `json:"database"`
+	CnosdbMode            CnosdbMode        `json:"cnosdbMode"`
+	Tenant                string            `json:"tenant"`
+	ApiKey                string            `json:"apiKey"`
+	EnableHttps           bool              `json:"enableHttps"`
+	CaCert                string            `json:"caCert"`
+	TLSAuth               bool              `json:"tlsAuth"`
+	TLSAuthWithCACert     bool              `json:"tlsAuthWithCACert"`
+	TLSSkipVerify         bool              `json:"tlsSkipVerify"`
+	ServerName            string            `json:"serverName"`
+	AuthType              AuthType          `json:"authType"`
+	IdentityMappings      []IdentityMapping `json:"identityMappings"`
+	AllowedDatabases      []string          `json:"allowedDatabases"`
+	AllowedTenants        []string          `json:"allowedTenants"`
+	TargetPartitions      int               `json:"targetPartitions"`
+	StreamTriggerInterval string            `json:"streamTriggerInterval"`
+	UseChunkedResponse    bool              `json:"useChunkedResponse"`
+	MinInterval           string            `json:"minInterval"`
+	AllowedStatements     []string          `json:"allowedStatements"`
+	RetryAttempts         int               `json:"retryAttempts"`
+	RetryBackoff          string            `json:"retryBackoff"`
+	RetryTimeout          string            `json:"retryTimeout"`
+	Endpoints             []string          `json:"endpoints"`
+	LoadBalancing         LoadBalancing     `json:"loadBalancing"`
+	EndpointCooldown      string            `json:"endpointCooldown"`
+	QueryTimeout          string            `json:"queryTimeout"`
+	KillQueryOnCancel     bool              `json:"killQueryOnCancel"`
+	MaxRows               int               `json:"maxRows"`
+	MaxBytes              int64             `json:"maxBytes"`
+	DefaultLimit          int               `json:"defaultLimit"`
+}
+
+// minInterval returns the lower limit of automatic intervals, e.g. "10s" or ">10s".
+func (c *CnosdbDataSourceOptions) minInterval() time.Duration {
+	if c.MinInterval == "" {
+		return 0
+	}
+	interval, err := ParseMacroInterval(strings.TrimPrefix(c.MinInterval, ">"))
+	if err != nil {
+		log.DefaultLogger.Warn("Invalid min interval", "minInterval", c.MinInterval, "error", err)
+		return 0
+	}
+	return interval
+}
+
+// apiKey returns the API key of CnosDB cloud from the secure JSON data. Datasources created by older
+// versions keep the key in ApiKey until they are saved again.
+func (c *CnosdbDataSourceOptions) apiKey(secureJsonData map[string]string) string {
+	if apiKey := secureJsonData["apiKey"]; apiKey != "" {
+		return apiKey
+	}
+	if c.ApiKey != "" {
+		log.DefaultLogger.Warn("API key is stored in plain text, save the datasource to encrypt it")
+	}
+	return c.ApiKey
+}
+
+// queryTimeout returns the time a query may run, 0 if queries don't time out.
+func (c *CnosdbDataSourceOptions) queryTimeout() time.Duration {
+	if c.QueryTimeout == "" {
+		return 0
+	}
+	timeout, err := ParseMacroInterval(c.QueryTimeout)
+	if err != nil {
+		log.DefaultLogger.Warn("Invalid query timeout", "queryTimeout", c.QueryTimeout, "error", err)
+	}
+	return timeout
+}
+
+// retryOptions returns the retry options, invalid durations fall back to the defaults.
+func (c *CnosdbDataSourceOptions) retryOptions() RetryOptions {
+	options := RetryOptions{Attempts: c.RetryAttempts}
+	if c.RetryBackoff != "" {
+		backoff, err := ParseMacroInterval(c.RetryBackoff)
+		if err != nil {
+			log.DefaultLogger.Warn("Invalid retry backoff", "retryBackoff", c.RetryBackoff, "error", err)
+		}
+		options.Backoff = backoff
+	}
+	if c.RetryTimeout != "" {
+		timeout, err := ParseMacroInterval(c.RetryTimeout)
+		if err != nil {
+			log.DefaultLogger.Warn("Invalid retry timeout", "retryTimeout", c.RetryTimeout, "error", err)
+		}
+		options.Timeout = timeout
+	}
+	return options
+}
+
+// buildEndpointUrls returns the base URL followed by the URLs of the additional endpoints, which are
+// "host:port" or URLs. All endpoints share the scheme and path prefix of the base URL.
+func (c *CnosdbDataSourceOptions) buildEndpointUrls() ([]*url.URL, error) {
+	primary, err := c.buildCnosdbUrl()
+	if err != nil {
+		return nil, err
+	}
+	urls := []*url.URL{primary}
+	for _, endpoint := range c.Endpoints {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+		rawUrl := endpoint
+		if !strings.Contains(rawUrl, "://") {
+			rawUrl = fmt.Sprintf("%s://%s", primary.Scheme, rawUrl)
+		}
+		u, err := url.Parse(rawUrl)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+		}
+		// Only the host of an endpoint is used by EndpointTransport
+		if strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid endpoint %q: endpoints share the path of the URL %q", endpoint, primary.String())
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// defaultLimit returns the LIMIT of builder queries without a limit, 0 for no limit. It defaults to
+// DefaultLimit, a negative DefaultLimit disables the limit.
+func (c *CnosdbDataSourceOptions) defaultLimit() int {
+	if c.DefaultLimit == 0 {
+		return DefaultLimit
+	}
+	if c.DefaultLimit < 0 {
+		return 0
+	}
+	return c.DefaultLimit
 }
 
+// responseLimits returns the limits of query responses, unset limits fall back to the defaults.
+func (c *CnosdbDataSourceOptions) responseLimits() ResponseLimits {
+	limits := ResponseLimits{MaxRows: c.MaxRows, MaxBytes: c.MaxBytes}
+	if limits.MaxRows <= 0 {
+		limits.MaxRows = DefaultMaxRows
+	}
+	if limits.MaxBytes <= 0 {
+		limits.MaxBytes = DefaultMaxBytes
+	}
+	return limits
+}
+
+func (c *CnosdbDataSourceOptions) endpointCooldown() time.Duration {
+	if c.EndpointCooldown == "" {
+		return 0
+	}
+	cooldown, err := ParseMacroInterval(c.EndpointCooldown)
+	if err != nil {
+		log.DefaultLogger.Warn("Invalid endpoint cool-down", "endpointCooldown", c.EndpointCooldown, "error", err)
+	}
+	return cooldown
+}
+
+// buildCnosdbUrl returns the base URL of CnosDB, which may have a path prefix. Datasources created
+// before Url existed are configured by Host, Port and EnableHttps.
 func (c *CnosdbDataSourceOptions) buildCnosdbUrl() (*url.URL, error) {
+	if c.Url == "" {
+		return c.buildLegacyUrl()
+	}
+
+	rawUrl := strings.TrimSpace(c.Url)
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "http://" + rawUrl
+	}
+	baseUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", c.Url, err)
+	}
+	if baseUrl.Scheme != "http" && baseUrl.Scheme != "https" {
+		return nil, fmt.Errorf("invalid URL %q: scheme must be http or https", c.Url)
+	}
+	if baseUrl.Hostname() == "" {
+		return nil, fmt.Errorf("invalid URL %q: missing host", c.Url)
+	}
+	baseUrl.RawQuery = ""
+	baseUrl.Fragment = ""
+	baseUrl.Path = strings.TrimSuffix(baseUrl.Path, "/")
+	baseUrl.RawPath = ""
+	return baseUrl, nil
+}
+
+func (c *CnosdbDataSourceOptions) buildLegacyUrl() (*url.URL, error) {
+	scheme := "http"
 	if c.EnableHttps {
-		urlStr := fmt.Sprintf("https://%s:%d", c.Host, c.Port)
-		return url.Parse(urlStr)
-	} else {
-		urlStr := fmt.Sprintf("http://%s:%d", c.Host, c.Port)
-		return url.Parse(urlStr)
+		scheme = "https"
 	}
+	// IPv6 addresses may be configured with or without brackets.
+	host := strings.TrimSuffix(strings.TrimPrefix(c.Host, "["), "]")
+	if host == "" {
+		return nil, errors.New("missing host")
+	}
+	if c.Port != 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(c.Port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return &url.URL{Scheme: scheme, Host: host}, nil
 }
 
 // NewCnosdbDatasource creates a new datasource instance.
@@ -94,11 +278,10 @@ func NewCnosdbDatasource(instanceSettings backend.DataSourceInstanceSettings) (i
 	if dsConfigJsonData.CnosdbMode == CnosdbModePublicCloud {
 		// Cloud mode doesn't need those
 		httpOptions.BasicAuth = nil
-		httpOptions.TLS.CACertificate = ""
-		httpOptions.TLS.ClientCertificate = ""
-		httpOptions.TLS.ClientKey = ""
+		dsConfigJsonData.TLSAuth = false
+		dsConfigJsonData.AuthType = ""
 
-		cnosdbApi, err = NewCnosdbCloudApi(&dsConfigJsonData)
+		cnosdbApi, err = NewCnosdbCloudApi(&dsConfigJsonData, dsConfigJsonData.apiKey(instanceSettings.DecryptedSecureJSONData))
 		if err != nil {
 			return nil, fmt.Errorf("invalid CnosDB cloud API: %w", err)
 		}
@@ -109,16 +292,37 @@ func NewCnosdbDatasource(instanceSettings backend.DataSourceInstanceSettings) (i
 		}
 	}
 
+	if dsConfigJsonData.AuthType == AuthTypeBearerToken || dsConfigJsonData.AuthType == AuthTypeOAuthPassThrough {
+		// The SDK would set the basic auth header of every request
+		httpOptions.BasicAuth = nil
+	}
+	applyTLSOptions(&httpOptions, &dsConfigJsonData, instanceSettings.DecryptedSecureJSONData)
+
 	httpClient, err := httpclient.New(httpOptions)
 	if err != nil {
 		return nil, fmt.Errorf("create http client: %w", err)
 	}
+	endpointUrls, err := dsConfigJsonData.buildEndpointUrls()
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := NewEndpointPool(endpointUrls, dsConfigJsonData.LoadBalancing, dsConfigJsonData.endpointCooldown())
+	if err != nil {
+		return nil, err
+	}
+	httpClient.Transport = NewRetryTransport(
+		NewEndpointTransport(httpClient.Transport, endpoints),
+		dsConfigJsonData.retryOptions(),
+	)
 
 	return &CnosdbDatasource{
-		options:     dsConfigJsonData,
-		httpOptions: httpOptions,
-		client:      httpClient,
-		api:         cnosdbApi,
+		options:        dsConfigJsonData,
+		httpOptions:    httpOptions,
+		client:         httpClient,
+		api:            cnosdbApi,
+		endpoints:      endpoints,
+		bearerToken:    instanceSettings.DecryptedSecureJSONData["bearerToken"],
+		secureJsonData: instanceSettings.DecryptedSecureJSONData,
 	}, nil
 }
 
@@ -127,9 +331,19 @@ func NewCnosdbDatasource(instanceSettings backend.DataSourceInstanceSettings) (i
 type CnosdbDatasource struct {
 	options CnosdbDataSourceOptions
 
-	httpOptions httpclient.Options
-	client      *http.Client
-	api         Api
+	httpOptions    httpclient.Options
+	client         *http.Client
+	api            Api
+	endpoints      *EndpointPool
+	bearerToken    string
+	secureJsonData map[string]string
+
+	// caps are the capabilities of the server version, detected on first use. capsDetected is
+	// closed when the running detection ends, a failed detection is retried after capsRetryAt.
+	capsMu       sync.Mutex
+	caps         *Capabilities
+	capsDetected chan struct{}
+	capsRetryAt  time.Time
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -146,6 +360,14 @@ func (d *CnosdbDatasource) Dispose() {
 func (d *CnosdbDatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	// Create response struct
 	response := backend.NewQueryDataResponse()
+	ctx = withForwardedHeaders(ctx, req)
+	ctx, err := d.withQueryTarget(ctx, req.PluginContext)
+	if err != nil {
+		for _, q := range req.Queries {
+			response.Responses[q.RefID] = backend.ErrDataResponse(StatusOf(err), err.Error())
+		}
+		return response, nil
+	}
 
 	// Loop over queries and execute them individually.
 	// TODO: Use goroutine instead of serial execution.
@@ -170,67 +392,152 @@ func (d *CnosdbDatasource) query(ctx context.Context, queryContext *backend.Quer
 	if err = queryModel.Introspect(); err != nil {
 		return backend.ErrDataResponse(backend.StatusValidationFailed, err.Error())
 	}
+	timeout, err := queryModel.QueryTimeout(d.options.queryTimeout())
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusValidationFailed, err.Error())
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
 	// Build sql
-	sql := queryModel.Build(queryContext)
+	queryModel.SetCapabilities(d.capabilities(ctx))
+	statements, err := queryModel.BuildStatements(&query, &d.options)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusValidationFailed, err.Error())
+	}
+	for _, statement := range statements {
+		if err = CheckStatements(statement.SQL, d.options.AllowedStatements); err != nil {
+			return errDataResponseWithQuery(NewStatusError(backend.StatusValidationFailed, err.Error()), statement.SQL)
+		}
+	}
+
+	if len(statements) == 1 {
+		frame, err := d.executeStatement(ctx, statements[0].Query, &query, statements[0].SQL)
+		if err != nil {
+			return errDataResponseWithQuery(err, statements[0].SQL)
+		}
+		response.Frames = append(response.Frames, frame)
+		return response
+	}
+
+	// Each statement returns a named frame, a failed statement returns a frame with an error notice.
+	frames := make(data.Frames, len(statements))
+	execute := func(i int) {
+		frame, err := d.executeStatement(ctx, statements[i].Query, &query, statements[i].SQL)
+		if err != nil {
+			frame = errFrame(err, statements[i].SQL)
+			frame.AppendNotices(data.Notice{Text: err.Error(), Severity: data.NoticeSeverityError})
+		}
+		frame.Name = fmt.Sprintf("statement_%d", i+1)
+		frames[i] = frame
+	}
+	if queryModel.ConcurrentStatements {
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, MaxConcurrentStatements)
+		for i := range statements {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(i int) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				execute(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range statements {
+			execute(i)
+		}
+	}
+	response.Frames = frames
+
+	return response
+}
 
+// executeStatement runs a single SQL statement and converts its result to a frame.
+func (d *CnosdbDatasource) executeStatement(ctx context.Context, queryModel *QueryModel, query *backend.DataQuery, sql string) (*data.Frame, error) {
 	// Build HTTP request
-	req, err := d.api.BuildQueryRequest(ctx, d, sql)
+	target, err := d.queryModelTarget(ctx, queryModel)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusInternal, err.Error())
+		return nil, err
+	}
+	// A query is tagged with an id, so that it can be killed when it is cancelled
+	var queryID string
+	taggedSql := sql
+	if d.options.KillQueryOnCancel {
+		queryID = newQueryID()
+		taggedSql = tagQuery(sql, queryID)
+	}
+	req, err := d.api.BuildQueryRequest(ctx, d, target, taggedSql)
+	if errors.Is(err, errNoOAuthIdentity) {
+		return nil, NewStatusError(backend.StatusUnauthorized, err.Error())
+	} else if err != nil {
+		return nil, NewStatusError(backend.StatusInternal, err.Error())
+	}
+	if isReadOnlyStatement(sql) {
+		req = withIdempotent(req)
 	}
 
 	// Do HTTP request
+	var stats QueryStats
+	requestStart := time.Now()
 	res, err := d.client.Do(req)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadGateway, err.Error())
+		return nil, d.cancelledError(ctx, target, queryID, err)
 	}
 	defer res.Body.Close()
 
 	// Handle HTTP response
-	respData, err := io.ReadAll(res.Body)
-	if err != nil && !errors.Is(err, io.EOF) {
-		// Error while receiving request payload
-		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
-	}
-
+	limits := d.options.responseLimits()
 	if res.StatusCode/100 != 2 {
-		var errMsg map[string]string
-		if err := json.NewDecoder(bytes.NewReader(respData)).Decode(&errMsg); err != nil {
-			return backend.ErrDataResponse(
-				backend.StatusBadRequest,
-				fmt.Sprintf("Query failed with status '%s', error: Failed to parse response: %s", res.Status, err),
-			)
+		respData, err := io.ReadAll(io.LimitReader(res.Body, limits.MaxBytes))
+		if err != nil {
+			return nil, d.cancelledError(ctx, target, queryID, err)
 		}
-		if error_code, ok := errMsg["error_code"]; ok {
-			return backend.ErrDataResponse(
-				backend.StatusBadRequest,
-				fmt.Sprintf("Query failed with status '%s', error code: %s, error: %s", res.Status, error_code, errMsg["error_message"]),
-			)
-		} else {
-			return backend.ErrDataResponse(
-				backend.StatusBadRequest,
-				fmt.Sprintf("Query failed with status '%s', error: %s", res.Status, errMsg["message"]),
-			)
+		cnosdbErr := ParseCnosdbError(res, respData)
+		statusErr := cnosdbErr.StatusError()
+		if table, ok := cnosdbErr.MissingTable(); ok {
+			if table == "" {
+				table = queryModel.Table
+			}
+			statusErr.Hint = d.missingTableHint(ctx, queryModel, table)
 		}
-
+		return nil, statusErr
 	}
 
-	var resRows []map[string]interface{}
-	var resultNotEmpty = true
-	if len(respData) > 0 {
-		if err := json.NewDecoder(bytes.NewReader(respData)).Decode(&resRows); err != nil {
-			return backend.ErrDataResponse(
-				backend.StatusInternal,
-				fmt.Sprintf("Failed to decode response jsonData: %s", err),
-			)
-		}
-	} else {
-		resultNotEmpty = false
+	// Rows are decoded while they are received, up to the limits of the datasource
+	decoded, err := decodeRows(res.Body, limits)
+	if err != nil && ctx.Err() != nil {
+		return nil, d.cancelledError(ctx, target, queryID, err)
+	} else if err != nil {
+		return nil, NewDownstreamError(
+			backend.StatusInternal,
+			fmt.Sprintf("Failed to decode response jsonData: %s", err),
+		)
 	}
+	resRows := decoded.Rows
+	resultNotEmpty := decoded.BytesRead > 0
+	stats.Latency = time.Since(requestStart)
+	stats.BytesReceived = int(decoded.BytesRead)
+	stats.RowsDecoded = len(resRows)
 
 	// Create data frame response.
 	frame := data.NewFrame("response")
+	frame.Meta = &data.FrameMeta{
+		ExecutedQueryString: sql,
+		Custom:              NewFrameMetaCustom(queryModel),
+	}
+	if decoded.Truncated != "" {
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("The result is truncated to %d rows, %s", len(resRows), decoded.Truncated),
+		})
+	}
 	timeArray := make([]time.Time, len(resRows))
 	valueArrayMap := make(map[string]Array)
 	var columnArray []string
@@ -243,7 +550,7 @@ func (d *CnosdbDatasource) query(ctx context.Context, queryContext *backend.Quer
 					parsedTime, err := ParseTimeString(val.(string))
 					if err != nil {
 						errStr := fmt.Sprintf("Failed to convert to time: %s", err.Error())
-						return backend.ErrDataResponse(backend.StatusInternal, errStr)
+						return nil, NewStatusError(backend.StatusInternal, errStr)
 					}
 					timeArray[i] = parsedTime
 				} else {
@@ -297,7 +604,7 @@ func (d *CnosdbDatasource) query(ctx context.Context, queryContext *backend.Quer
 	}
 
 	// Resample if needed
-	if resultNotEmpty && queryModel.Fill != "" {
+	if resultNotEmpty && queryModel.Fill != "" && !queryModel.gapfill {
 		log.DefaultLogger.Debug("Fill detected, need Resample", "fill", queryModel.Fill)
 		var fillMode data.FillMode
 		var fillValue float64 = 0
@@ -310,12 +617,12 @@ func (d *CnosdbDatasource) query(ctx context.Context, queryContext *backend.Quer
 			fillMode = data.FillModeValue
 			fillValue, err = strconv.ParseFloat(queryModel.Fill, 64)
 			if err != nil {
-				frame.AppendNotices(data.Notice{Text: "Failed to convert fill value to float", Severity: data.NoticeSeverityWarning})
-				return backend.ErrDataResponse(backend.StatusInternal, err.Error())
+				return nil, NewStatusError(backend.StatusInternal, fmt.Sprintf("Failed to convert fill value to float: %s", err))
 			}
 		}
 		interval := ParseIntervalString(queryModel.Interval)
 		if interval != 0 {
+			resampleStart := time.Now()
 			frame, err = Resample(frame, interval, query.TimeRange, &data.FillMissing{
 				Mode:  fillMode,
 				Value: fillValue,
@@ -323,51 +630,63 @@ func (d *CnosdbDatasource) query(ctx context.Context, queryContext *backend.Quer
 			if err != nil {
 				frame.AppendNotices(data.Notice{Text: "Failed to Resample dataframe", Severity: data.NoticeSeverityWarning})
 			}
+			stats.ResampleTime = time.Since(resampleStart)
 		}
 	}
+	frame.Meta.Stats = stats.FrameStats()
 
-	// Add the frames to the response.
-	response.Frames = append(response.Frames, frame)
+	return frame, nil
+}
 
+// errDataResponseWithQuery returns an error response with a frame that carries the executed SQL,
+// so that the failed statement can still be seen in the query inspector.
+func errDataResponseWithQuery(err error, sql string) backend.DataResponse {
+	response := backend.ErrDataResponse(StatusOf(err), err.Error())
+	response.Frames = append(response.Frames, errFrame(err, sql))
 	return response
 }
 
-// CheckHealth handles health checks sent from Grafana to the plugin.
-// The main use case for these health checks is the test button on the
-// datasource configuration page which allows users to verify that
-// a datasource is working as expected.
-func (d *CnosdbDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	pingReq, err := d.api.BuildPingRequest(ctx, d)
-	if err != nil {
-		return nil, fmt.Errorf("failed to build ping request: %w", err)
+func errFrame(err error, sql string) *data.Frame {
+	frame := data.NewFrame("response")
+	frame.Meta = &data.FrameMeta{
+		ExecutedQueryString: sql,
+		Custom:              NewErrorMetaCustom(err),
 	}
+	return frame
+}
 
-	res, err := d.client.Do(pingReq)
+// missingTableHint suggests the existing table whose name is closest to table.
+func (d *CnosdbDatasource) missingTableHint(ctx context.Context, queryModel *QueryModel, table string) string {
+	if table == "" {
+		return ""
+	}
+	// List the tables of the database the query was run on
+	tablesQuery := &QueryModel{Database: queryModel.Database, Tenant: queryModel.Tenant}
+	frame, err := d.executeStatement(ctx, tablesQuery, &backend.DataQuery{}, "SHOW TABLES")
 	if err != nil {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: fmt.Sprintf("Ping CnosDB failed: %s", err),
-		}, nil
+		log.DefaultLogger.Debug("Failed to list tables", "error", err)
+		return ""
 	}
 
-	pingResponse, err := io.ReadAll(res.Body)
-	if err != nil {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: fmt.Sprintf("Ping CnosDB not return anything"),
-		}, nil
-	}
-	if res.StatusCode/100 == 2 {
-		return &backend.CheckHealthResult{
-			Status:      backend.HealthStatusOk,
-			Message:     "Data source is working",
-			JSONDetails: pingResponse,
-		}, nil
-	} else {
-		return &backend.CheckHealthResult{
-			Status:      backend.HealthStatusError,
-			Message:     "Ping CnosDB returned error",
-			JSONDetails: pingResponse,
-		}, nil
+	suggestion := ""
+	bestDistance := len(table)/3 + 2
+	for _, field := range frame.Fields {
+		if field.Type() != data.FieldTypeNullableString {
+			continue
+		}
+		for i := 0; i < field.Len(); i++ {
+			name, ok := field.ConcreteAt(i)
+			if !ok {
+				continue
+			}
+			if distance := LevenshteinDistance(table, name.(string)); distance < bestDistance {
+				suggestion, bestDistance = name.(string), distance
+			}
+		}
+		break
+	}
+	if suggestion == "" || suggestion == table {
+		return fmt.Sprintf("table not found: %s", table)
 	}
+	return fmt.Sprintf("table not found: did you mean %s?", suggestion)
 }
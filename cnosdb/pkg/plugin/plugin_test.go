@@ -2,12 +2,21 @@ package plugin_test
 
 import (
 	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/cnosdb/cnos-cnosdb-datasource-backend/pkg/plugin"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
 )
 
 // This is where the tests for the datasource backend live.
@@ -59,3 +68,317 @@ func TestResample(t *testing.T) {
 	}
 
 }
+
+// newTestDatasource creates a datasource connected to a test server running handler.
+func newTestDatasource(t *testing.T, handler http.HandlerFunc) *plugin.CnosdbDatasource {
+	return newTestDatasourceWithOptions(t, handler, nil)
+}
+
+// newTestDatasourceWithOptions creates a datasource connected to a test server running handler,
+// options are added to the JSON data of the datasource.
+func newTestDatasourceWithOptions(t *testing.T, handler http.HandlerFunc, options map[string]interface{}) *plugin.CnosdbDatasource {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(serverUrl.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonOptions := map[string]interface{}{
+		"host":     serverUrl.Hostname(),
+		"port":     port,
+		"database": "public",
+	}
+	for k, v := range options {
+		jsonOptions[k] = v
+	}
+	jsonData, err := json.Marshal(jsonOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := plugin.NewCnosdbDatasource(backend.DataSourceInstanceSettings{JSONData: jsonData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return instance.(*plugin.CnosdbDatasource)
+}
+
+func TestQueryDataFrameMeta(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","value":1.5},{"time":"2022-10-10T00:01:00","value":2.5}]`))
+	})
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{
+					RefID: "A",
+					JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT time, value FROM t WHERE $timeFilter"}`),
+					TimeRange: backend.TimeRange{
+						From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+						To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
+					},
+				},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := resp.Responses["A"]
+	assert.NoError(t, res.Error)
+	assert.Len(t, res.Frames, 1)
+	meta := res.Frames[0].Meta
+	assert.Equal(t, "SELECT time, value FROM t WHERE time >= 1665360000000000000 AND time <= 1665964800000000000", meta.ExecutedQueryString)
+	assert.Len(t, meta.Stats, 4)
+	assert.Equal(t, "Rows decoded", meta.Stats[2].DisplayName)
+	assert.Equal(t, float64(2), meta.Stats[2].Value)
+}
+
+func TestQueryDataMultipleStatements(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "missing") {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte(`{"error_code":"010001","error_message":"table not found"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","value":1.5}]`))
+	})
+
+	for _, concurrent := range []bool{false, true} {
+		queryJson, _ := json.Marshal(map[string]interface{}{
+			"rawQuery":             true,
+			"queryText":            "SELECT time, value FROM a; SELECT time, value FROM missing; SELECT time, value FROM b;",
+			"concurrentStatements": concurrent,
+		})
+		resp, err := ds.QueryData(
+			context.Background(),
+			&backend.QueryDataRequest{Queries: []backend.DataQuery{{RefID: "A", JSON: queryJson}}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := resp.Responses["A"]
+		assert.NoError(t, res.Error)
+		assert.Len(t, res.Frames, 3)
+		assert.Equal(t, "statement_1", res.Frames[0].Name)
+		assert.Equal(t, "SELECT time, value FROM a", res.Frames[0].Meta.ExecutedQueryString)
+		assert.Equal(t, 1, res.Frames[0].Rows())
+		assert.Equal(t, "statement_2", res.Frames[1].Name)
+		assert.Len(t, res.Frames[1].Meta.Notices, 1)
+		assert.Equal(t, data.NoticeSeverityError, res.Frames[1].Meta.Notices[0].Severity)
+		assert.Equal(t, "statement_3", res.Frames[2].Name)
+		assert.Equal(t, 1, res.Frames[2].Rows())
+	}
+}
+
+func TestQueryDataBoundsConcurrentStatements(t *testing.T) {
+	var running, maxRunning int32
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/ping" {
+			_, _ = w.Write([]byte(`{"version":"2.3.0","status":"healthy"}`))
+			return
+		}
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","value":1.5}]`))
+	})
+
+	queryJson, _ := json.Marshal(map[string]interface{}{
+		"rawQuery":             true,
+		"queryText":            strings.Repeat("SELECT time, value FROM t;", 3*plugin.MaxConcurrentStatements),
+		"concurrentStatements": true,
+	})
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{RefID: "A", JSON: queryJson}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, resp.Responses["A"].Error)
+	assert.Len(t, resp.Responses["A"].Frames, 3*plugin.MaxConcurrentStatements)
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxRunning), int32(plugin.MaxConcurrentStatements))
+}
+
+func TestQueryDataTableNotFoundHint(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(string(body), "SHOW TABLES") {
+			_, _ = w.Write([]byte(`[{"table_name":"cpu_usage"},{"table_name":"mem_usage"}]`))
+			return
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(`{"error_code":"010001","error_message":"Table not found: \"public.cpu_usag\""}`))
+	})
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{Queries: []backend.DataQuery{{
+			RefID: "A",
+			JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT * FROM cpu_usag"}`),
+		}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := resp.Responses["A"]
+	assert.Error(t, res.Error)
+	assert.Equal(t, backend.StatusNotFound, res.Status)
+	assert.Contains(t, res.Error.Error(), "table not found: did you mean cpu_usage?")
+	custom := res.Frames[0].Meta.Custom.(*plugin.ErrorMetaCustom)
+	assert.Equal(t, plugin.ErrorSourceDownstream, custom.ErrorSource)
+	assert.Equal(t, "010001", custom.ErrorCode)
+}
+
+func TestQueryDataTruncatesLargeResults(t *testing.T) {
+	rows := `[{"time":"2022-10-10T00:00:00","value":1},{"time":"2022-10-10T00:01:00","value":2},{"time":"2022-10-10T00:02:00","value":3}]`
+	tests := []struct {
+		name    string
+		options map[string]interface{}
+		rows    int
+		notice  string
+	}{
+		{name: "within limits", options: nil, rows: 3},
+		{
+			name:    "max rows",
+			options: map[string]interface{}{"maxRows": 2},
+			rows:    2,
+			notice:  "The result is truncated to 2 rows, the result exceeded the maximum of 2 rows",
+		},
+		{
+			name:    "max bytes",
+			options: map[string]interface{}{"maxBytes": 60},
+			rows:    1,
+			notice:  "The result is truncated to 1 rows, the response exceeded the maximum size of 60 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := newTestDatasourceWithOptions(t, func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(rows))
+			}, tt.options)
+
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+				RefID: "A",
+				JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT time, value FROM t"}`),
+			}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := resp.Responses["A"]
+			assert.NoError(t, res.Error)
+			assert.Equal(t, tt.rows, res.Frames[0].Rows())
+			if tt.notice == "" {
+				assert.Empty(t, res.Frames[0].Meta.Notices)
+			} else {
+				assert.Equal(t, []data.Notice{{Severity: data.NoticeSeverityWarning, Text: tt.notice}}, res.Frames[0].Meta.Notices)
+			}
+		})
+	}
+}
+
+func TestQueryDataResamplesSubSecondInterval(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/ping" {
+			_, _ = w.Write([]byte(`{"version":"2.2.0","status":"healthy"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","value":1},{"time":"2022-10-10T00:00:01.500","value":2}]`))
+	})
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID: "A",
+		JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT $__timeGroupAlias(time, '500ms', null), value FROM t WHERE $timeFilter"}`),
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 200000000, time.UTC),
+			To:   time.Date(2022, 10, 10, 0, 0, 2, 0, time.UTC),
+		},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resp.Responses["A"]
+	assert.NoError(t, res.Error)
+	// The buckets at 0s, 0.5s, 1s, 1.5s and 2s
+	assert.Equal(t, 5, res.Frames[0].Rows())
+	assert.Equal(t, time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC), res.Frames[0].Fields[0].At(0).(time.Time).UTC())
+}
+
+func TestQueryDataResamplesEachStatement(t *testing.T) {
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/ping" {
+			_, _ = w.Write([]byte(`{"version":"2.2.0","status":"healthy"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","value":1},{"time":"2022-10-10T00:00:01.500","value":2}]`))
+	})
+
+	// The fill of the first statement doesn't resample the results of the second one
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID: "A",
+		JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT $__timeGroupAlias(time, '500ms', null), value FROM t; SELECT time, value FROM u"}`),
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 10, 10, 0, 0, 2, 0, time.UTC),
+		},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resp.Responses["A"]
+	assert.NoError(t, res.Error)
+	assert.Len(t, res.Frames, 2)
+	assert.Equal(t, 5, res.Frames[0].Rows())
+	assert.Equal(t, 2, res.Frames[1].Rows())
+}
+
+func TestQueryDataResamplesAutoInterval(t *testing.T) {
+	var executed string
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/ping" {
+			// Empty buckets are resampled by the plugin before gapfill
+			_, _ = w.Write([]byte(`{"version":"2.2.0","status":"healthy"}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		executed = string(body)
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","avg":1},{"time":"2022-10-10T00:00:00.500","avg":2}]`))
+	})
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: []backend.DataQuery{{
+		RefID: "A",
+		JSON: []byte(`{
+    "table": "t",
+    "select": [[ { "type": "field", "params": [ "value" ] }, { "type": "avg" } ]],
+    "groupBy": [ { "type": "time", "params": [ "auto" ] }, { "type": "fill", "params": [ "null" ] } ]
+}`),
+		MaxDataPoints: 10,
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 10, 10, 0, 0, 1, 0, time.UTC),
+		},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resp.Responses["A"]
+	assert.NoError(t, res.Error)
+	assert.Contains(t, executed, "DATE_BIN(INTERVAL '100 milliseconds', time")
+	// The buckets from 0s to 1s
+	assert.Equal(t, 11, res.Frames[0].Rows())
+}
@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+var regexpHavingValue = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+
+// HavingItem is a condition on the groups of a query, Column is the name of a selected aggregate, i.e.
+// its alias or its default name, e.g. "avg" for `field(cpu), avg()`, see selectorColumnNames, and
+// Value a number.
+type HavingItem struct {
+	Column    string `json:"column"`
+	Operator  string `json:"operator,omitempty"`
+	Value     string `json:"value"`
+	Condition string `json:"condition,omitempty"`
+}
+
+// isAggregate returns true if a selector aggregates the rows of a group.
+func isAggregate(sel []*SelectItem) bool {
+	for _, s := range sel {
+		switch s.Type {
+		case "field", "tag", "math", "alias":
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// validateHaving checks that the conditions of Having filter selected aggregates by a number.
+func (query *QueryModel) validateHaving() error {
+	if len(query.Having) == 0 {
+		return nil
+	}
+
+	// The names are unique, so that each condition filters exactly one selector
+	selectors := map[string][]*SelectItem{}
+	var aggregates []string
+	for i, name := range query.selectorColumnNames() {
+		sel := query.Select[i]
+		if isAggregate(sel) && windowPartIndex(sel) < 0 {
+			aggregates = append(aggregates, name)
+		}
+		selectors[name] = sel
+	}
+
+	for _, item := range query.Having {
+		sel, ok := selectors[item.Column]
+		if !ok {
+			return fmt.Errorf("cannot filter by %q, it is not selected, available aggregates are: %s", item.Column, strings.Join(aggregates, ", "))
+		}
+		if windowPartIndex(sel) >= 0 {
+			return fmt.Errorf("cannot filter by %q, it is computed by a window function", item.Column)
+		}
+		if !isAggregate(sel) {
+			return fmt.Errorf("cannot filter by %q, it is not an aggregate", item.Column)
+		}
+		switch item.Operator {
+		case "", "=", "!=", "<>", "<", "<=", ">", ">=":
+		default:
+			return fmt.Errorf("invalid operator %q of %q", item.Operator, item.Column)
+		}
+		if !regexpHavingValue.MatchString(item.Value) {
+			return fmt.Errorf("invalid value %q of %q, use a number", item.Value, item.Column)
+		}
+		switch strings.ToUpper(item.Condition) {
+		case "", "AND", "OR":
+		default:
+			return fmt.Errorf("invalid condition %q of %q, use AND or OR", item.Condition, item.Column)
+		}
+	}
+	return nil
+}
+
+// renderHaving renders the conditions of Having on the expressions of the aggregates, the aliases
+// of the selectors can't be referenced before the groups are selected.
+func (query *QueryModel) renderHaving(dataQuery *backend.DataQuery) string {
+	if len(query.Having) == 0 {
+		return ""
+	}
+
+	var conditions []string
+	for i, item := range query.Having {
+		str := ""
+		if i > 0 {
+			if item.Condition == "" {
+				str += "AND "
+			} else {
+				str += strings.ToUpper(item.Condition) + " "
+			}
+		}
+
+		operator := item.Operator
+		if operator == "" {
+			operator = "="
+		}
+		conditions = append(conditions, fmt.Sprintf("%s%s %s %s", str, query.renderAggregate(dataQuery, item.Column), operator, item.Value))
+	}
+	return " HAVING " + strings.Join(conditions, " ")
+}
+
+// renderAggregate renders the expression of the selector named column, without its alias.
+func (query *QueryModel) renderAggregate(dataQuery *backend.DataQuery, column string) string {
+	var sel []*SelectItem
+	for i, name := range query.selectorColumnNames() {
+		if name == column {
+			sel = query.Select[i]
+			break
+		}
+	}
+
+	stk := ""
+	for _, s := range sel {
+		if s.Type != "alias" {
+			stk = s.Render(query, dataQuery, stk)
+		}
+	}
+	return stk
+}
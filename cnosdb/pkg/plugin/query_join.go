@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// A query can select from a subquery instead of a table, and join the table or subquery with
+// another query on the time and tag columns of both, e.g. the ratio of two metrics:
+//
+//	SELECT time, "host", "used" / "total" AS "ratio" FROM (
+//	  SELECT DATE_BIN(...) AS time, "host", avg("used") AS "used" FROM mem GROUP BY ...
+//	) JOIN (
+//	  SELECT DATE_BIN(...) AS time, "host", avg("total") AS "total" FROM mem_total GROUP BY ...
+//	) USING (time, "host") WHERE time >= ... AND time <= ...
+//
+// The columns of USING are merged, so that they can be referenced without a table name. The other
+// columns of nested queries are named by their aliases or qualified by their fields, e.g. "avg_used",
+// and must differ between the joined queries.
+
+const (
+	JoinTypeInner = "INNER"
+	JoinTypeLeft  = "LEFT"
+	JoinTypeRight = "RIGHT"
+	JoinTypeFull  = "FULL"
+)
+
+// JoinModel joins the source of a query with another query on the columns of Using, which must
+// include the time.
+type JoinModel struct {
+	// Type is INNER, LEFT, RIGHT or FULL, defaults to INNER
+	Type  string      `json:"type,omitempty"`
+	Query *QueryModel `json:"query,omitempty"`
+	Using []string    `json:"using,omitempty"`
+}
+
+func (join *JoinModel) validate() error {
+	switch strings.ToUpper(join.Type) {
+	case "", JoinTypeInner, JoinTypeLeft, JoinTypeRight, JoinTypeFull:
+	default:
+		return fmt.Errorf("invalid join type %q, use INNER, LEFT, RIGHT or FULL", join.Type)
+	}
+	if join.Query == nil {
+		return fmt.Errorf("the joined query is missing")
+	}
+	if len(join.Using) == 0 {
+		return fmt.Errorf("a join needs the time or tag columns to join on")
+	}
+	// Both queries select the time, which would be ambiguous in the query unless it is merged by USING
+	for _, column := range join.Using {
+		if column == ColumnTime {
+			return nil
+		}
+	}
+	return fmt.Errorf("a join must be on time, add time to the join columns")
+}
+
+// renderSources renders the table or subquery selected from, and the joined query. Nested queries
+// are built for the server of the query, select their GROUP BY tags and name all their columns,
+// and aren't limited by the default limit of the datasource.
+func (query *QueryModel) renderSources(dataQuery *backend.DataQuery, options *CnosdbDataSourceOptions) error {
+	query.source = query.Table
+	if query.Subquery != nil {
+		if query.Table != "" {
+			return fmt.Errorf("a query selects from either table %q or a subquery", query.Table)
+		}
+		query.Subquery.capabilities = query.capabilities
+		query.Subquery.nested = true
+		sql, err := query.Subquery.render(dataQuery, options, 0)
+		if err != nil {
+			return fmt.Errorf("subquery: %w", err)
+		}
+		query.source = fmt.Sprintf("(%s)", sql)
+	}
+
+	if query.Join != nil {
+		if err := query.Join.validate(); err != nil {
+			return err
+		}
+		query.Join.Query.capabilities = query.capabilities
+		query.Join.Query.nested = true
+		sql, err := query.Join.Query.render(dataQuery, options, 0)
+		if err != nil {
+			return fmt.Errorf("joined query: %w", err)
+		}
+		query.joined = sql
+
+		if query.Subquery != nil {
+			if err := query.Join.checkColumns(query.Subquery); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkColumns checks that the columns of the joined query and of the subquery it is joined with
+// differ, except for the columns of Using, so that the query can reference them without a table name.
+func (join *JoinModel) checkColumns(subquery *QueryModel) error {
+	columns := map[string]bool{}
+	for _, column := range subquery.outputColumns() {
+		columns[column] = true
+	}
+	for _, column := range join.Using {
+		delete(columns, column)
+	}
+	for _, column := range join.Query.outputColumns() {
+		if columns[column] {
+			return fmt.Errorf("column %q is selected by both joined queries, alias it or add it to the join columns", column)
+		}
+	}
+	return nil
+}
+
+func (query *QueryModel) renderJoin() string {
+	joinType := strings.ToUpper(query.Join.Type)
+	if joinType == "" {
+		joinType = JoinTypeInner
+	}
+	using := make([]string, len(query.Join.Using))
+	for i, column := range query.Join.Using {
+		if column == ColumnTime {
+			using[i] = ColumnTime
+		} else {
+			using[i] = quoteIdentifier(column)
+		}
+	}
+	return fmt.Sprintf(" %s JOIN (%s) USING (%s)", joinType, query.joined, strings.Join(using, ", "))
+}
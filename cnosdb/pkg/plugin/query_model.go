@@ -2,17 +2,14 @@ package plugin
 
 import (
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 )
 
-var (
-	RegexpTimeFilter1 = CompileVariableRegexp("timeFilter")
-	RegexpTimeFilter2 = CompileVariableRegexp("__timeFilter")
-	RegexpInterval    = CompileVariableRegexp("__interval")
-)
-
 const (
 	GroupTypeTime = "time"
 	GroupTypeFill = "fill"
@@ -20,14 +17,20 @@ const (
 
 const DefaultLimit = 1000
 
+// LimitNone as the Limit of a query disables the default limit of the datasource.
+const LimitNone = "none"
+
+// IntervalAuto lets the interval be derived from the interval and max data points of the Grafana query.
+const IntervalAuto = "auto"
+
 type SelectItem struct {
 	Def    *QueryDefinition
 	Type   string   `json:"type,omitempty"`
 	Params []string `json:"params,omitempty"`
 }
 
-func (s *SelectItem) Render(query *QueryModel, queryContext *backend.QueryDataRequest, expr string) string {
-	return s.Def.Renderer(query, queryContext, s, expr)
+func (s *SelectItem) Render(query *QueryModel, dataQuery *backend.DataQuery, expr string) string {
+	return s.Def.Renderer(query, dataQuery, s, expr)
 }
 
 type TagItem struct {
@@ -38,33 +41,82 @@ type TagItem struct {
 }
 
 type QueryModel struct {
-	Table       string          `json:"table,omitempty"`
+	Table string `json:"table,omitempty"`
+	// Subquery is selected from instead of Table, Join is joined with Table or Subquery
+	Subquery *QueryModel `json:"subquery,omitempty"`
+	Join     *JoinModel  `json:"join,omitempty"`
+
 	Select      [][]*SelectItem `json:"select,omitempty"`
 	Tags        []*TagItem      `json:"tags,omitempty"`
 	RawTagsExpr string          `json:"rawTagsExpr,omitempty"`
 	GroupBy     []*SelectItem   `json:"groupBy,omitempty"`
+	Having      []*HavingItem   `json:"having,omitempty"`
 	Interval    string          `json:"interval,omitempty"`
 	Fill        string          `json:"fill,omitempty"`
 	OrderByTime string          `json:"orderByTime,omitempty"`
+	OrderBy     []*OrderByItem  `json:"orderBy,omitempty"`
 	Limit       string          `json:"limit,omitempty"`
+	Offset      string          `json:"offset,omitempty"`
 	Tz          string          `json:"tz,omitempty"`
-
-	RawQuery  bool   `json:"rawQuery,omitempty"`
-	QueryText string `json:"queryText,omitempty"`
-	Alias     string `json:"alias,omitempty"`
+	// SLimit limits the number of series grouped by tags, SeriesLimit the number of rows of each series
+	SLimit      string `json:"slimit,omitempty"`
+	SeriesLimit string `json:"seriesLimit,omitempty"`
+	// Database and Tenant override the database and tenant of the datasource for this query
+	Database string `json:"database,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	// Timeout overrides the query timeout of the datasource, e.g. "5m"
+	Timeout string `json:"timeout,omitempty"`
+
+	RawQuery             bool   `json:"rawQuery,omitempty"`
+	QueryText            string `json:"queryText,omitempty"`
+	Alias                string `json:"alias,omitempty"`
+	ConcurrentStatements bool   `json:"concurrentStatements,omitempty"`
+
+	resolvedInterval time.Duration
+	defaultLimit     int
+	// source is the rendered table or subquery of the FROM clause, joined the rendered joined query
+	source string
+	joined string
+	// nested is true for a subquery or joined query, whose columns are referenced by the outer query
+	nested       bool
+	capabilities *Capabilities
+	// gapfill is true if empty time buckets are filled by the server instead of resampling
+	gapfill bool
 }
 
 func (query *QueryModel) Introspect() error {
 	for _, sel := range query.Select {
+		// Functions, math and aliases are applied to the field or tag of the selector
+		hasExpr := false
 		for _, s := range sel {
 			def, exists := renders[s.Type]
 			if !exists {
 				return fmt.Errorf("missing query definition for %q", s.Type)
 			}
+			if err := def.Validate(s); err != nil {
+				return err
+			}
 			s.Def = &def
+			if s.Type == "field" || s.Type == "tag" {
+				hasExpr = true
+			} else if !hasExpr {
+				return fmt.Errorf("%s: select a field to apply it to", s.Type)
+			}
+		}
+		if err := validateWindowParts(sel); err != nil {
+			return err
 		}
 	}
 	for _, s := range query.GroupBy {
+		def, exists := renders[s.Type]
+		if !exists {
+			return fmt.Errorf("missing query definition for %q", s.Type)
+		}
+		if err := def.Validate(s); err != nil {
+			return err
+		}
+		s.Def = &def
+
 		if s.Type == GroupTypeTime {
 			// from: GROUP BY time($interval)
 			// to: "GROUP BY time", "DATE_BIN(... $interval ...) AS time"
@@ -72,63 +124,242 @@ func (query *QueryModel) Introspect() error {
 		} else if s.Type == GroupTypeFill {
 			query.Fill = s.Params[0]
 		}
-		def, exists := renders[s.Type]
-		if !exists {
-			return fmt.Errorf("missing query definition for %q", s.Type)
-		}
-		s.Def = &def
 	}
 	if query.RawQuery {
 		query.Fill = ""
 	}
 
+	if query.Subquery != nil {
+		if err := query.Subquery.Introspect(); err != nil {
+			return fmt.Errorf("subquery: %w", err)
+		}
+	}
+	if query.Join != nil && query.Join.Query != nil {
+		if err := query.Join.Query.Introspect(); err != nil {
+			return fmt.Errorf("joined query: %w", err)
+		}
+	}
 	return nil
 }
 
-func (query *QueryModel) Build(queryContext *backend.QueryDataRequest) string {
+func (query *QueryModel) Build(dataQuery *backend.DataQuery, options *CnosdbDataSourceOptions) (string, error) {
+	res, err := query.render(dataQuery, options, options.defaultLimit())
+	if err != nil {
+		return "", err
+	}
+
+	mc := &MacroContext{
+		Query:     query,
+		TimeRange: dataQuery.TimeRange,
+		Interval:  query.resolvedInterval,
+	}
+	return ExpandMacros(mc, res)
+}
+
+// Statement is a statement of a query and the query it is run and resampled by.
+type Statement struct {
+	SQL   string
+	Query *QueryModel
+}
+
+// BuildStatements builds the query like Build and splits it into its statements. The macros of each
+// statement are expanded on a copy of the query, so that the fill and interval set by a macro, e.g.
+// `$__timeGroup(time, 1m, null)`, only resample the results of the statement using it.
+func (query *QueryModel) BuildStatements(dataQuery *backend.DataQuery, options *CnosdbDataSourceOptions) ([]Statement, error) {
+	res, err := query.render(dataQuery, options, options.defaultLimit())
+	if err != nil {
+		return nil, err
+	}
+
+	sqls := SplitStatements(res)
+	if len(sqls) <= 1 {
+		sqls = []string{res}
+	}
+	statements := make([]Statement, len(sqls))
+	for i, sql := range sqls {
+		statementQuery := *query
+		mc := &MacroContext{
+			Query:     &statementQuery,
+			TimeRange: dataQuery.TimeRange,
+			Interval:  query.resolvedInterval,
+		}
+		if statements[i].SQL, err = ExpandMacros(mc, sql); err != nil {
+			return nil, err
+		}
+		statements[i].Query = &statementQuery
+	}
+	return statements, nil
+}
+
+// render renders the query before its macros are expanded, a query without limit is limited to
+// defaultLimit rows if it is not 0.
+func (query *QueryModel) render(dataQuery *backend.DataQuery, options *CnosdbDataSourceOptions, defaultLimit int) (string, error) {
+	query.resolvedInterval = query.resolveInterval(dataQuery, options.minInterval())
+	query.defaultLimit = defaultLimit
+	if err := query.validateLimits(); err != nil {
+		return "", err
+	}
+	// The builder fields don't apply to the raw text of a query
+	if !(query.RawQuery && query.QueryText != "") {
+		if err := query.validateColumnNames(); err != nil {
+			return "", err
+		}
+		if err := query.validateOrderBy(); err != nil {
+			return "", err
+		}
+		if err := query.validateHaving(); err != nil {
+			return "", err
+		}
+	}
+	caps := query.Capabilities()
+	if query.Interval != "" && !(query.RawQuery && query.QueryText != "") {
+		if _, err := caps.timeBucket(query.Interval, ColumnTime); err != nil {
+			return "", err
+		}
+	}
+	if !(query.RawQuery && query.QueryText != "") {
+		if err := query.renderSources(dataQuery, options); err != nil {
+			return "", err
+		}
+	}
+
 	var res string
 	if query.RawQuery && query.QueryText != "" {
-		res = query.QueryText
+		res = caps.rewriteMetadataQuery(query.QueryText)
+	} else if query.hasWindowFunctions() {
+		res = query.renderWindowQuery(dataQuery)
 	} else {
-		res = query.renderSelectors(queryContext)
+		query.gapfill = caps.Gapfill && query.Interval != "" && (query.Fill == FillNull || query.Fill == FillPrevious)
+		res = query.renderSelectors(dataQuery)
 		res += query.renderMeasurement()
 		res += query.renderWhereClause()
-		res += query.renderTimeFilter(queryContext)
-		res += query.renderGroupBy(queryContext)
-		res += query.renderOrderByTime()
+		res += query.renderTimeFilter(dataQuery)
+		res += query.renderGroupBy(dataQuery)
+		res += query.renderHaving(dataQuery)
+		if query.hasSeriesLimits() {
+			res = query.renderSeriesLimits(dataQuery, res)
+		}
+		res += query.renderOrderBy(dataQuery)
 		res += query.renderLimit()
 	}
+	return res, nil
+}
 
-	resBytes := []byte(res)
-	timeFilter := []byte(query.renderTimeFilter(queryContext))
-	resBytes = RegexpTimeFilter1.ReplaceAll(resBytes, timeFilter)
-	resBytes = RegexpTimeFilter2.ReplaceAll(resBytes, timeFilter)
-	resBytes = RegexpInterval.ReplaceAll(resBytes, []byte(query.Interval))
+// SetCapabilities sets the capabilities of the server the query is built for.
+func (query *QueryModel) SetCapabilities(caps Capabilities) {
+	query.capabilities = &caps
+}
 
-	return string(resBytes)
+// Capabilities returns the capabilities set by SetCapabilities, or DefaultCapabilities.
+func (query *QueryModel) Capabilities() Capabilities {
+	if query.capabilities == nil {
+		return DefaultCapabilities
+	}
+	return *query.capabilities
 }
 
-func (query *QueryModel) renderTimeFilter(queryContext *backend.QueryDataRequest) string {
-	timeRange := &queryContext.Queries[0].TimeRange
-	if timeRange == nil {
-		return ""
+// QueryTimeout returns the time the query may run, the Timeout of the query overrides defaultTimeout.
+func (query *QueryModel) QueryTimeout(defaultTimeout time.Duration) (time.Duration, error) {
+	if query.Timeout == "" {
+		return defaultTimeout, nil
 	}
+	timeout, err := ParseMacroInterval(query.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid query timeout %q", query.Timeout)
+	}
+	return timeout, nil
+}
+
+// ResolvedInterval returns the interval of time buckets used by the last Build.
+func (query *QueryModel) ResolvedInterval() time.Duration {
+	return query.resolvedInterval
+}
+
+// defaultMaxDataPoints bounds the number of automatic time buckets if Grafana suggests neither
+// an interval nor max data points.
+const defaultMaxDataPoints = 1000
+
+// resolveInterval returns the interval of time buckets. A fixed interval is normalized to
+// CnosDB syntax, otherwise the interval suggested by Grafana is used, widened if needed so
+// that no more than MaxDataPoints buckets are returned, rounded to a human-friendly step and
+// raised to minInterval. An automatic interval is dropped if there is nothing to derive it from.
+func (query *QueryModel) resolveInterval(dataQuery *backend.DataQuery, minInterval time.Duration) time.Duration {
+	if interval, err := ParseMacroInterval(query.Interval); err == nil {
+		query.Interval = FormatIntervalString(interval)
+		return interval
+	}
+	if query.Interval != "" && query.Interval != IntervalAuto {
+		return 0
+	}
+
+	interval := dataQuery.Interval
+	maxDataPoints := dataQuery.MaxDataPoints
+	if maxDataPoints <= 0 && interval <= 0 {
+		maxDataPoints = defaultMaxDataPoints
+	}
+	if maxDataPoints > 0 {
+		bucketInterval := time.Duration(math.Ceil(float64(dataQuery.TimeRange.Duration()) / float64(maxDataPoints)))
+		if interval < bucketInterval {
+			interval = bucketInterval
+		}
+	}
+	if interval > 0 {
+		interval = RoundInterval(interval)
+	}
+	if interval < minInterval {
+		interval = minInterval
+	}
+	if interval <= 0 {
+		if query.Interval == IntervalAuto {
+			query.Interval = ""
+		}
+		return 0
+	}
+	if query.Interval == IntervalAuto {
+		query.Interval = FormatIntervalString(interval)
+	}
+	return interval
+}
+
+func (query *QueryModel) renderTimeFilter(dataQuery *backend.DataQuery) string {
+	timeRange := dataQuery.TimeRange
 	return fmt.Sprintf("time >= %d AND time <= %d", timeRange.From.UnixNano(), timeRange.To.UnixNano())
 }
 
-func (query *QueryModel) renderSelectors(queryContext *backend.QueryDataRequest) string {
-	res := "SELECT "
+func (query *QueryModel) renderTimeSelector() string {
 	if query.Interval != "" {
-		res += fmt.Sprintf("DATE_BIN(INTERVAL '%s', time, TIMESTAMP '1970-01-01T00:00:00Z') AS time, ", query.Interval)
-	} else {
-		res += "time, "
+		return query.renderTimeBucket() + " AS time"
+	}
+	return "time"
+}
+
+// renderTimeBucket returns the time bucket of the interval, which Build has checked to be supported
+// by the server. Empty buckets are added by date_bin_gapfill if the server fills them.
+func (query *QueryModel) renderTimeBucket() string {
+	if query.gapfill {
+		return fmt.Sprintf("date_bin_gapfill(INTERVAL '%s', time, TIMESTAMP '1970-01-01T00:00:00Z')", query.Interval)
+	}
+	bucket, _ := query.Capabilities().timeBucket(query.Interval, ColumnTime)
+	return bucket
+}
+
+func (query *QueryModel) renderSelectors(dataQuery *backend.DataQuery) string {
+	res := "SELECT " + query.renderTimeSelector() + ", "
+	// The tags of a subquery or joined query are selected to be joined on or grouped by
+	if query.nested {
+		for _, tag := range query.renderGroupByTags(dataQuery) {
+			res += tag + ", "
+		}
 	}
 
+	names := query.selectorColumnNames()
 	var selectors []string
-	for _, sel := range query.Select {
-		stk := ""
-		for _, s := range sel {
-			stk = s.Render(query, queryContext, stk)
+	for i, sel := range query.Select {
+		stk := query.renderSelector(dataQuery, sel)
+		if alias, ok := selectorAlias(sel); ok {
+			stk = fmt.Sprintf("%s AS %s", stk, quoteIdentifier(alias))
+		} else if query.namesColumns() {
+			stk = fmt.Sprintf("%s AS %s", stk, quoteIdentifier(names[i]))
 		}
 		selectors = append(selectors, stk)
 	}
@@ -136,8 +367,35 @@ func (query *QueryModel) renderSelectors(queryContext *backend.QueryDataRequest)
 	return res + strings.Join(selectors, ", ")
 }
 
+// renderSelector renders the expression of a selector without its alias, the previous value is
+// carried into empty buckets by locf.
+func (query *QueryModel) renderSelector(dataQuery *backend.DataQuery, sel []*SelectItem) string {
+	stk := ""
+	for _, s := range sel {
+		if s.Type == "alias" {
+			continue
+		}
+		stk = s.Render(query, dataQuery, stk)
+	}
+	if query.gapfill && query.Fill == FillPrevious {
+		stk = fmt.Sprintf("locf(%s)", stk)
+	}
+	return stk
+}
+
+// namesColumns returns true if the selectors without alias are aliased with their column names, i.e.
+// the columns of a query with series limits or of a nested query are referenced by name. The columns of
+// other queries keep the names of their expressions, so that e.g. sorting doesn't rename them.
+func (query *QueryModel) namesColumns() bool {
+	return query.hasSeriesLimits() || query.nested
+}
+
 func (query *QueryModel) renderMeasurement() string {
-	return fmt.Sprintf(` FROM %s`, query.Table)
+	res := fmt.Sprintf(` FROM %s`, query.source)
+	if query.Join != nil {
+		res += query.renderJoin()
+	}
+	return res
 }
 
 func (query *QueryModel) renderTags() []string {
@@ -192,7 +450,7 @@ func (query *QueryModel) renderWhereClause() string {
 	return res
 }
 
-func (query *QueryModel) renderGroupBy(queryContext *backend.QueryDataRequest) string {
+func (query *QueryModel) renderGroupBy(dataQuery *backend.DataQuery) string {
 	groupBy := ""
 	for i, group := range query.GroupBy {
 		if i == 0 {
@@ -203,7 +461,7 @@ func (query *QueryModel) renderGroupBy(queryContext *backend.QueryDataRequest) s
 			groupBy += ", "
 		}
 
-		groupBy += group.Render(query, queryContext, "")
+		groupBy += group.Render(query, dataQuery, "")
 	}
 
 	return groupBy
@@ -217,10 +475,181 @@ func (query *QueryModel) renderOrderByTime() string {
 	return fmt.Sprintf(" ORDER BY time %s", orderByTime)
 }
 
+// validateLimits checks that the limits and the offset are numbers, the limit may be LimitNone, and
+// that the series limited by slimit are grouped by tags unless the query runs its raw text.
+func (query *QueryModel) validateLimits() error {
+	limits := []struct {
+		name  string
+		value string
+	}{
+		{"limit", query.Limit},
+		{"offset", query.Offset},
+		{"slimit", query.SLimit},
+		{"series limit", query.SeriesLimit},
+	}
+	for _, limit := range limits {
+		if limit.value == "" || (limit.name == "limit" && limit.value == LimitNone) {
+			continue
+		}
+		if n, err := strconv.Atoi(limit.value); err != nil || n < 0 {
+			return fmt.Errorf("invalid %s %q", limit.name, limit.value)
+		}
+	}
+	if query.SLimit != "" && !(query.RawQuery && query.QueryText != "") && !query.hasGroupByTags() {
+		return fmt.Errorf("slimit %q limits the series of the GROUP BY tags, group the query by a tag", query.SLimit)
+	}
+	return nil
+}
+
 func (query *QueryModel) renderLimit() string {
-	limit := query.Limit
-	if limit == "" {
-		return fmt.Sprintf(" LIMIT %d", DefaultLimit)
+	res := ""
+	switch query.Limit {
+	case "":
+		if query.defaultLimit > 0 {
+			res = fmt.Sprintf(" LIMIT %d", query.defaultLimit)
+		}
+	case LimitNone:
+	default:
+		res = fmt.Sprintf(" LIMIT %s", query.Limit)
+	}
+	if query.Offset != "" {
+		res += fmt.Sprintf(" OFFSET %s", query.Offset)
 	}
-	return fmt.Sprintf(" LIMIT %s", limit)
+	return res
+}
+
+func (query *QueryModel) hasGroupByTags() bool {
+	for _, group := range query.GroupBy {
+		if group.Type == "tag" {
+			return true
+		}
+	}
+	return false
+}
+
+func (query *QueryModel) hasSeriesLimits() bool {
+	return query.SLimit != "" || query.SeriesLimit != ""
+}
+
+// renderSeriesLimits limits the series grouped by tags and the rows of each series by ranking the
+// rows of the grouped query:
+//
+//	SELECT time, "tag", "avg" FROM (
+//	  SELECT *, ROW_NUMBER() OVER (PARTITION BY "tag" ORDER BY time ASC) AS "_row",
+//	    DENSE_RANK() OVER (ORDER BY "tag") AS "_series" FROM (SELECT ... GROUP BY ...)
+//	) WHERE "_row" <= 10 AND "_series" <= 5
+//
+// Series are kept in the order of their tags, rows in the order of time.
+func (query *QueryModel) renderSeriesLimits(dataQuery *backend.DataQuery, grouped string) string {
+	tags := query.renderGroupByTags(dataQuery)
+	orderByTime := query.OrderByTime
+	if orderByTime == "" {
+		orderByTime = "ASC"
+	}
+
+	var ranks, conditions []string
+	if query.SeriesLimit != "" {
+		over := fmt.Sprintf("ORDER BY %s %s", ColumnTime, orderByTime)
+		if len(tags) > 0 {
+			over = fmt.Sprintf("PARTITION BY %s %s", strings.Join(tags, ", "), over)
+		}
+		ranks = append(ranks, fmt.Sprintf(`ROW_NUMBER() OVER (%s) AS "_row"`, over))
+		conditions = append(conditions, fmt.Sprintf(`"_row" <= %s`, query.SeriesLimit))
+	}
+	if query.SLimit != "" {
+		ranks = append(ranks, fmt.Sprintf(`DENSE_RANK() OVER (ORDER BY %s) AS "_series"`, strings.Join(tags, ", ")))
+		conditions = append(conditions, fmt.Sprintf(`"_series" <= %s`, query.SLimit))
+	}
+	if len(ranks) == 0 {
+		return grouped
+	}
+
+	columns := append([]string{ColumnTime}, tags...)
+	for _, name := range query.selectorColumnNames() {
+		columns = append(columns, quoteIdentifier(name))
+	}
+	ranked := fmt.Sprintf("SELECT *, %s FROM (%s)", strings.Join(ranks, ", "), grouped)
+	return fmt.Sprintf("SELECT %s FROM (%s) WHERE %s", strings.Join(columns, ", "), ranked, strings.Join(conditions, " AND "))
+}
+
+// selectorAlias returns the alias of a selector.
+func selectorAlias(sel []*SelectItem) (string, bool) {
+	if len(sel) > 0 && sel[len(sel)-1].Type == "alias" {
+		return sel[len(sel)-1].Params[0], true
+	}
+	return "", false
+}
+
+// selectorField returns the field a selector is computed from, or "" if it has none.
+func selectorField(sel []*SelectItem) string {
+	for _, s := range sel {
+		if s.Type == "field" && len(s.Params) > 0 {
+			return s.Params[0]
+		}
+	}
+	return ""
+}
+
+// selectorColumnNames returns the names of the selectors, i.e. their aliases or the names they are
+// aliased with if the columns are referenced by name, e.g. "avg" for `field(fa), avg()`. A name
+// shared by several selectors or taken by another column, or of a nested query, is qualified by the
+// field, e.g. "avg_fa", and numbered if it is still not unique, e.g. "avg_fa_2".
+func (query *QueryModel) selectorColumnNames() []string {
+	taken := map[string]bool{ColumnTime: true}
+	for _, group := range query.GroupBy {
+		if group.Type == "tag" {
+			taken[group.Params[0]] = true
+		}
+	}
+	shared := map[string]int{}
+	for _, sel := range query.Select {
+		if alias, ok := selectorAlias(sel); ok {
+			taken[alias] = true
+		} else {
+			shared[windowColumnName(sel)]++
+		}
+	}
+
+	names := make([]string, len(query.Select))
+	for i, sel := range query.Select {
+		if alias, ok := selectorAlias(sel); ok {
+			names[i] = alias
+			continue
+		}
+		name := windowColumnName(sel)
+		field := selectorField(sel)
+		// The columns of a nested query are qualified, so that they differ from the ones of the query it is joined with
+		if (query.nested || shared[name] > 1 || taken[name]) && field != "" && field != "*" && field != name {
+			name += "_" + field
+		}
+		unique := name
+		for n := 2; taken[unique]; n++ {
+			unique = fmt.Sprintf("%s_%d", name, n)
+		}
+		taken[unique] = true
+		names[i] = unique
+	}
+	return names
+}
+
+// validateColumnNames checks that the aliases of the selectors are distinct from each other and from
+// the time and tag columns, so that the columns can be referenced by name.
+func (query *QueryModel) validateColumnNames() error {
+	taken := map[string]bool{ColumnTime: true}
+	for _, group := range query.GroupBy {
+		if group.Type == "tag" {
+			taken[group.Params[0]] = true
+		}
+	}
+	for _, sel := range query.Select {
+		alias, ok := selectorAlias(sel)
+		if !ok {
+			continue
+		}
+		if taken[alias] {
+			return fmt.Errorf("duplicate column name %q, alias the selectors with distinct names", alias)
+		}
+		taken[alias] = true
+	}
+	return nil
 }
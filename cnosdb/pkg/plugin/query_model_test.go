@@ -26,15 +26,11 @@ func TestParseSimpleQuery(t *testing.T) {
     ],
     "orderByTime": "ASC"
 }`
-	queryContext := &backend.QueryDataRequest{
-		Queries: []backend.DataQuery{
-			{
-				JSON: []byte(requestJson),
-				TimeRange: backend.TimeRange{
-					From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
-					To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
-				},
-			},
+	dataQuery := &backend.DataQuery{
+		JSON: []byte(requestJson),
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
 		},
 	}
 	var queryModel plugin.QueryModel
@@ -45,7 +41,10 @@ func TestParseSimpleQuery(t *testing.T) {
 		t.Error(err)
 	}
 
-	sql := queryModel.Build(queryContext)
+	sql, err := queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	assert.Equal(t, sql, "SELECT DATE_BIN(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z') AS time, avg(\"fa\")"+
 		" FROM mq WHERE time >= 1665360000000000000 AND time <= 1665964800000000000"+
 		" GROUP BY DATE_BIN(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z')"+
@@ -80,15 +79,11 @@ func TestParseQueryComplex(t *testing.T) {
     "table": "ma",
     "tags": []
 }`
-	queryContext := &backend.QueryDataRequest{
-		Queries: []backend.DataQuery{
-			{
-				JSON: []byte(requestJson),
-				TimeRange: backend.TimeRange{
-					From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
-					To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
-				},
-			},
+	dataQuery := &backend.DataQuery{
+		JSON: []byte(requestJson),
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
 		},
 	}
 	var queryModel plugin.QueryModel
@@ -99,7 +94,10 @@ func TestParseQueryComplex(t *testing.T) {
 		t.Error(err)
 	}
 
-	sql := queryModel.Build(queryContext)
+	sql, err := queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	assert.Equal(t, sql, "SELECT DATE_BIN(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z') AS time, avg(\"fa\") AS \"value\""+
 		" FROM ma WHERE time >= 1665360000000000000 AND time <= 1665964800000000000"+
 		" GROUP BY DATE_BIN(INTERVAL '10 minutes', time, TIMESTAMP '1970-01-01T00:00:00Z'), \"ta\""+
@@ -127,15 +125,11 @@ func TestParseRawQuery(t *testing.T) {
 	"select":[[{"params":["default_field"],"type":"field"},{"params":[],"type":"avg"}]],
 	"tags":[]
 }`
-	queryContext := &backend.QueryDataRequest{
-		Queries: []backend.DataQuery{
-			{
-				JSON: []byte(requestJson),
-				TimeRange: backend.TimeRange{
-					From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
-					To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
-				},
-			},
+	dataQuery := &backend.DataQuery{
+		JSON: []byte(requestJson),
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
 		},
 	}
 	var queryModel plugin.QueryModel
@@ -146,6 +140,750 @@ func TestParseRawQuery(t *testing.T) {
 		t.Error(err)
 	}
 
-	sql := queryModel.Build(queryContext)
+	sql, err := queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	assert.Equal(t, sql, "Hello")
 }
+
+func TestParseQueryAutoInterval(t *testing.T) {
+	var requestJson = `
+{
+    "table": "mq",
+    "select": [
+        [
+            { "type": "field", "params": [ "fa"] },
+            { "type": "avg" }
+        ]
+    ],
+    "groupBy": [
+        { "type": "time", "params": [ "auto" ] }
+    ]
+}`
+	dataQuery := &backend.DataQuery{
+		JSON:          []byte(requestJson),
+		Interval:      time.Minute,
+		MaxDataPoints: 1000,
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 10, 10, 12, 0, 0, 0, time.UTC),
+		},
+	}
+	var queryModel plugin.QueryModel
+	if err := json.Unmarshal([]byte(requestJson), &queryModel); err != nil {
+		t.Error(err)
+	}
+	if err := queryModel.Introspect(); err != nil {
+		t.Error(err)
+	}
+
+	sql, err := queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sql, "SELECT DATE_BIN(INTERVAL '1 minute', time, TIMESTAMP '1970-01-01T00:00:00Z') AS time, avg(\"fa\")"+
+		" FROM mq WHERE time >= 1665360000000000000 AND time <= 1665403200000000000"+
+		" GROUP BY DATE_BIN(INTERVAL '1 minute', time, TIMESTAMP '1970-01-01T00:00:00Z')"+
+		" LIMIT 1000")
+
+	// 7 days in at most 1000 points needs buckets of at least 604.8 seconds, rounded up to 15 minutes.
+	queryModel.Interval = plugin.IntervalAuto
+	dataQuery.TimeRange.To = time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC)
+	if _, err = queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "15 minutes", queryModel.Interval)
+	assert.Equal(t, 15*time.Minute, queryModel.ResolvedInterval())
+
+	// The datasource min interval is a lower limit.
+	queryModel.Interval = plugin.IntervalAuto
+	if _, err = queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{MinInterval: ">1h"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1 hour", queryModel.Interval)
+
+	// The min interval is not rounded.
+	queryModel.Interval = plugin.IntervalAuto
+	dataQuery.Interval = time.Second
+	dataQuery.TimeRange.To = dataQuery.TimeRange.From.Add(time.Hour)
+	if _, err = queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{MinInterval: "45s"}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "45 seconds", queryModel.Interval)
+
+	// Without an interval and max data points from Grafana, the time range is split into at most 1000 buckets.
+	queryModel.Interval = plugin.IntervalAuto
+	dataQuery.TimeRange.To = time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC)
+	dataQuery.Interval = 0
+	dataQuery.MaxDataPoints = 0
+	if _, err = queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "15 minutes", queryModel.Interval)
+
+	// Nor with an empty time range.
+	queryModel.Interval = plugin.IntervalAuto
+	dataQuery.TimeRange = backend.TimeRange{}
+	sql, err = queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, sql, "auto")
+	assert.Equal(t, "", queryModel.Interval)
+}
+
+func TestBuildRawQueryInterval(t *testing.T) {
+	queryModel := plugin.QueryModel{
+		RawQuery:  true,
+		QueryText: "SELECT $__timeGroup(time, $__interval) FROM mq WHERE $timeFilter",
+	}
+	dataQuery := &backend.DataQuery{
+		Interval: 30 * time.Second,
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 10, 10, 1, 0, 0, 0, time.UTC),
+		},
+	}
+	sql, err := queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sql, "SELECT DATE_BIN(INTERVAL '30 seconds', time, TIMESTAMP '1970-01-01T00:00:00Z') FROM mq"+
+		" WHERE time >= 1665360000000000000 AND time <= 1665363600000000000")
+}
+
+func TestBuildSelectFunctions(t *testing.T) {
+	dataQuery := &backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	bucket := "DATE_BIN(INTERVAL '1 minute', time, TIMESTAMP '1970-01-01T00:00:00Z')"
+
+	tests := []struct {
+		name     string
+		sel      string
+		expected string
+	}{
+		{
+			name:     "first",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"first"}]`,
+			expected: `first(time, "fa")`,
+		},
+		{
+			name:     "count distinct",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"distinct"},{"type":"count"}]`,
+			expected: `count(DISTINCT "fa")`,
+		},
+		{
+			name:     "percentile_cont",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"percentile_cont","params":["0.95"]}]`,
+			expected: `percentile_cont(0.95) WITHIN GROUP (ORDER BY "fa")`,
+		},
+		{
+			name:     "approx_percentile",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"approx_percentile","params":["0.5"]}]`,
+			expected: `approx_percentile_cont("fa", 0.5)`,
+		},
+		{
+			name:     "math",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"avg"},{"type":"math","params":["/ 100"]},{"type":"alias","params":["pct"]}]`,
+			expected: `avg("fa") / 100 AS "pct"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestJson := `{"table":"mq","select":[` + tt.sel + `],"groupBy":[{"type":"time","params":["1 minute"]}]}`
+			var queryModel plugin.QueryModel
+			if err := json.Unmarshal([]byte(requestJson), &queryModel); err != nil {
+				t.Fatal(err)
+			}
+			if err := queryModel.Introspect(); err != nil {
+				t.Fatal(err)
+			}
+			sql, err := queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "SELECT "+bucket+" AS time, "+tt.expected+
+				" FROM mq WHERE time >= 1665360000000000000 AND time <= 1665964800000000000"+
+				" GROUP BY "+bucket+" LIMIT 1000", sql)
+		})
+	}
+}
+
+func TestIntrospectValidatesParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		sel      string
+		expected string
+	}{
+		{
+			name:     "missing parameter",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"moving_average"}]`,
+			expected: "moving_average: expected 1 parameter(s), got 0",
+		},
+		{
+			name:     "too many parameters",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"avg","params":["1"]}]`,
+			expected: "avg: expected 0 parameter(s), got 1",
+		},
+		{
+			name:     "invalid int",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"moving_average","params":["five"]}]`,
+			expected: `moving_average: invalid window parameter "five"`,
+		},
+		{
+			name:     "non-positive window",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"moving_average","params":["0"]}]`,
+			expected: `moving_average: invalid window parameter "0"`,
+		},
+		{
+			name:     "negative window",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"moving_average","params":["-3"]}]`,
+			expected: `moving_average: invalid window parameter "-3"`,
+		},
+		{
+			name:     "aggregation after window function",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"derivative"},{"type":"avg"}]`,
+			expected: "avg cannot be applied after derivative",
+		},
+		{
+			name:     "selector without field",
+			sel:      `[{"type":"last"}]`,
+			expected: "last: select a field to apply it to",
+		},
+		{
+			name:     "math without field",
+			sel:      `[{"type":"math","params":["* 2"]},{"type":"field","params":["fa"]}]`,
+			expected: "math: select a field to apply it to",
+		},
+		{
+			name:     "invalid math",
+			sel:      `[{"type":"field","params":["fa"]},{"type":"math","params":["; DROP TABLE mq"]}]`,
+			expected: `math: invalid expr parameter "; DROP TABLE mq"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queryModel plugin.QueryModel
+			if err := json.Unmarshal([]byte(`{"table":"mq","select":[`+tt.sel+`]}`), &queryModel); err != nil {
+				t.Fatal(err)
+			}
+			assert.EqualError(t, queryModel.Introspect(), tt.expected)
+		})
+	}
+}
+
+func TestBuildWindowQuery(t *testing.T) {
+	var requestJson = `
+{
+    "table": "mq",
+    "select": [
+        [
+            { "type": "field", "params": [ "fa" ] },
+            { "type": "max" },
+            { "type": "non_negative_derivative", "params": [ "1m" ] },
+            { "type": "alias", "params": [ "fa_rate" ] }
+        ],
+        [
+            { "type": "field", "params": [ "fb" ] },
+            { "type": "sum" },
+            { "type": "cumulative_sum" }
+        ],
+        [
+            { "type": "field", "params": [ "fc" ] },
+            { "type": "avg" },
+            { "type": "alias", "params": [ "fc_avg" ] }
+        ]
+    ],
+    "groupBy": [
+        { "type": "time", "params": [ "1 minute" ] },
+        { "type": "tag", "params": [ "ta" ] }
+    ],
+    "orderByTime": "ASC"
+}`
+	dataQuery := &backend.DataQuery{
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	var queryModel plugin.QueryModel
+	if err := json.Unmarshal([]byte(requestJson), &queryModel); err != nil {
+		t.Fatal(err)
+	}
+	if err := queryModel.Introspect(); err != nil {
+		t.Fatal(err)
+	}
+
+	sql, err := queryModel.Build(dataQuery, &plugin.CnosdbDataSourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := "DATE_BIN(INTERVAL '1 minute', time, TIMESTAMP '1970-01-01T00:00:00Z')"
+	over := `OVER (PARTITION BY "ta" ORDER BY time)`
+	assert.Equal(t, `SELECT time, "ta", `+
+		`CASE WHEN "_v0" >= lag("_v0") `+over+` THEN ("_v0" - lag("_v0") `+over+`) * 60000000000`+
+		` / (CAST(time AS BIGINT) - lag(CAST(time AS BIGINT)) `+over+`) END AS "fa_rate", `+
+		`sum("_v1") OVER (PARTITION BY "ta" ORDER BY time ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW) AS "cumulative_sum", `+
+		`"_v2" AS "fc_avg"`+
+		` FROM (SELECT `+bucket+` AS time, "ta", max("fa") AS "_v0", sum("fb") AS "_v1", avg("fc") AS "_v2"`+
+		` FROM mq WHERE time >= 1665360000000000000 AND time <= 1665964800000000000`+
+		` GROUP BY `+bucket+`, "ta")`+
+		` ORDER BY time ASC LIMIT 1000`, sql)
+}
+
+// buildQuery builds a query over the week from 2022-10-10 for the given options and server capabilities.
+func buildQuery(t *testing.T, requestJson string, options plugin.CnosdbDataSourceOptions, caps *plugin.Capabilities) (string, error) {
+	dataQuery := &backend.DataQuery{
+		JSON: []byte(requestJson),
+		TimeRange: backend.TimeRange{
+			From: time.Date(2022, 10, 10, 0, 0, 0, 0, time.UTC),
+			To:   time.Date(2022, 10, 17, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	var queryModel plugin.QueryModel
+	if err := json.Unmarshal([]byte(requestJson), &queryModel); err != nil {
+		t.Fatal(err)
+	}
+	if err := queryModel.Introspect(); err != nil {
+		t.Fatal(err)
+	}
+	if caps != nil {
+		queryModel.SetCapabilities(*caps)
+	}
+	return queryModel.Build(dataQuery, &options)
+}
+
+func TestBuildLimits(t *testing.T) {
+	const avg = `[ { "type": "field", "params": [ "fa" ] }, { "type": "avg" } ]`
+	query := func(selectors string, groupBy string, limits string) string {
+		return `{
+    "table": "mq",
+    "select": [` + selectors + `],
+    "groupBy": [ { "type": "time", "params": [ "1 hour" ] }` + groupBy + ` ],
+    "orderByTime": "ASC"` + limits + `
+}`
+	}
+	const selectors = `SELECT DATE_BIN(INTERVAL '1 hour', time, TIMESTAMP '1970-01-01T00:00:00Z') AS time, avg("fa")`
+	const grouped = ` FROM mq WHERE time >= 1665360000000000000 AND time <= 1665964800000000000` +
+		` GROUP BY DATE_BIN(INTERVAL '1 hour', time, TIMESTAMP '1970-01-01T00:00:00Z'), "host"`
+
+	tests := []struct {
+		name         string
+		selectors    string
+		groupBy      string
+		limits       string
+		defaultLimit int
+		want         string
+		wantErr      string
+	}{
+		{name: "default limit", want: selectors + grouped + " ORDER BY time ASC LIMIT 1000"},
+		{name: "datasource default limit", defaultLimit: 50, want: selectors + grouped + " ORDER BY time ASC LIMIT 50"},
+		{name: "datasource without limit", defaultLimit: -1, want: selectors + grouped + " ORDER BY time ASC"},
+		{name: "limit", limits: `, "limit": "20"`, defaultLimit: 50, want: selectors + grouped + " ORDER BY time ASC LIMIT 20"},
+		{name: "no limit", limits: `, "limit": "none"`, want: selectors + grouped + " ORDER BY time ASC"},
+		{name: "offset", limits: `, "limit": "20", "offset": "40"`, want: selectors + grouped + " ORDER BY time ASC LIMIT 20 OFFSET 40"},
+		{
+			name:   "series limit",
+			limits: `, "seriesLimit": "10"`,
+			want: `SELECT time, "host", "avg" FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY "host" ORDER BY time ASC) AS "_row" FROM (` +
+				selectors + ` AS "avg"` + grouped + `)) WHERE "_row" <= 10 ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:   "slimit and series limit",
+			limits: `, "slimit": "5", "seriesLimit": "10", "limit": "none"`,
+			want: `SELECT time, "host", "avg" FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY "host" ORDER BY time ASC) AS "_row",` +
+				` DENSE_RANK() OVER (ORDER BY "host") AS "_series" FROM (` + selectors + ` AS "avg"` + grouped +
+				`)) WHERE "_row" <= 10 AND "_series" <= 5 ORDER BY time ASC`,
+		},
+		{
+			name:      "series limit of selectors with the same name",
+			selectors: avg + `, [ { "type": "field", "params": [ "fb" ] }, { "type": "avg" } ], [ { "type": "field", "params": [ "fb" ] }, { "type": "avg" }, { "type": "math", "params": [ "* 2" ] } ]`,
+			limits:    `, "seriesLimit": "10"`,
+			want: `SELECT time, "host", "avg_fa", "avg_fb", "avg_fb_2" FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY "host" ORDER BY time ASC) AS "_row" FROM (` +
+				selectors + ` AS "avg_fa", avg("fb") AS "avg_fb", avg("fb") * 2 AS "avg_fb_2"` + grouped + `)) WHERE "_row" <= 10 ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:      "series limit of a selector named like an alias",
+			selectors: `[ { "type": "field", "params": [ "fa" ] }, { "type": "max" }, { "type": "alias", "params": [ "avg_fa" ] } ], ` + avg + `, [ { "type": "field", "params": [ "fb" ] }, { "type": "avg" } ]`,
+			limits:    `, "seriesLimit": "10"`,
+			want: `SELECT time, "host", "avg_fa", "avg_fa_2", "avg_fb" FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY "host" ORDER BY time ASC) AS "_row" FROM (` +
+				`SELECT DATE_BIN(INTERVAL '1 hour', time, TIMESTAMP '1970-01-01T00:00:00Z') AS time, max("fa") AS "avg_fa", avg("fa") AS "avg_fa_2", avg("fb") AS "avg_fb"` +
+				grouped + `)) WHERE "_row" <= 10 ORDER BY time ASC LIMIT 1000`,
+		},
+		{name: "invalid limit", limits: `, "limit": "1; DROP TABLE mq"`, wantErr: `invalid limit "1; DROP TABLE mq"`},
+		{name: "invalid offset", limits: `, "offset": "-1"`, wantErr: `invalid offset "-1"`},
+		{name: "invalid slimit", limits: `, "slimit": "none"`, wantErr: `invalid slimit "none"`},
+		{
+			name:    "slimit without tags",
+			groupBy: " ",
+			limits:  `, "slimit": "5"`,
+			wantErr: `slimit "5" limits the series of the GROUP BY tags, group the query by a tag`,
+		},
+		{
+			name:      "duplicate aliases",
+			selectors: `[ { "type": "field", "params": [ "fa" ] }, { "type": "avg" }, { "type": "alias", "params": [ "avg" ] } ], [ { "type": "field", "params": [ "fb" ] }, { "type": "max" }, { "type": "alias", "params": [ "avg" ] } ]`,
+			limits:    `, "seriesLimit": "10"`,
+			wantErr:   `duplicate column name "avg", alias the selectors with distinct names`,
+		},
+		{
+			name:      "raw query",
+			selectors: `[ { "type": "field", "params": [ "fa" ] }, { "type": "avg" }, { "type": "alias", "params": [ "host" ] } ]`,
+			groupBy:   " ",
+			limits:    `, "slimit": "5", "rawQuery": true, "queryText": "SELECT 1"`,
+			want:      "SELECT 1",
+		},
+		{
+			name:    "invalid slimit of a raw query",
+			groupBy: " ",
+			limits:  `, "slimit": "x", "rawQuery": true, "queryText": "SELECT 1"`,
+			wantErr: `invalid slimit "x"`,
+		},
+		{
+			name:      "alias of a tag",
+			selectors: `[ { "type": "field", "params": [ "fa" ] }, { "type": "avg" }, { "type": "alias", "params": [ "host" ] } ]`,
+			wantErr:   `duplicate column name "host", alias the selectors with distinct names`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selectors, groupBy := tt.selectors, tt.groupBy
+			if selectors == "" {
+				selectors = avg
+			}
+			if groupBy == "" {
+				groupBy = `, { "type": "tag", "params": [ "host" ] }`
+			}
+			sql, err := buildQuery(t, query(selectors, groupBy, tt.limits), plugin.CnosdbDataSourceOptions{DefaultLimit: tt.defaultLimit}, nil)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, sql)
+		})
+	}
+}
+
+func TestBuildOrderBy(t *testing.T) {
+	const selectors = `[ { "type": "field", "params": [ "fa" ] }, { "type": "avg" } ],
+        [ { "type": "field", "params": [ "fb" ] }, { "type": "max" }, { "type": "alias", "params": [ "peak \"b\"" ] } ]`
+	query := func(selectors string, orderBy string) string {
+		return `{
+    "table": "mq",
+    "select": [` + selectors + `],
+    "groupBy": [ { "type": "time", "params": [ "1 hour" ] }, { "type": "tag", "params": [ "host" ] } ],
+    "orderByTime": "ASC",
+    "orderBy": ` + orderBy + `
+}`
+	}
+	const timeBucket = `DATE_BIN(INTERVAL '1 hour', time, TIMESTAMP '1970-01-01T00:00:00Z')`
+	const selected = `SELECT ` + timeBucket + ` AS time, avg("fa"), max("fb") AS "peak ""b"""`
+	const from = ` FROM mq WHERE time >= 1665360000000000000 AND time <= 1665964800000000000 GROUP BY ` + timeBucket + `, "host"`
+
+	tests := []struct {
+		name      string
+		selectors string
+		orderBy   string
+		want      string
+		wantErr   string
+	}{
+		{
+			name:    "no sort keys",
+			orderBy: `[]`,
+			want:    selected + from + ` ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:    "aggregate",
+			orderBy: `[{ "column": "avg", "direction": "desc" }]`,
+			want:    selected + from + ` ORDER BY avg("fa") DESC, time ASC LIMIT 1000`,
+		},
+		{
+			name:    "alias and tag with nulls",
+			orderBy: `[{ "column": "peak \"b\"", "direction": "DESC", "nulls": "last" }, { "column": "host" }]`,
+			want:    selected + from + ` ORDER BY "peak ""b""" DESC NULLS LAST, "host", time ASC LIMIT 1000`,
+		},
+		{
+			name:    "time",
+			orderBy: `[{ "column": "time", "direction": "DESC", "nulls": "FIRST" }, { "column": "avg" }]`,
+			want:    selected + from + ` ORDER BY time DESC NULLS FIRST, avg("fa") LIMIT 1000`,
+		},
+		{
+			name:      "selectors with the same name",
+			selectors: `[ { "type": "field", "params": [ "fa" ] }, { "type": "avg" } ], [ { "type": "field", "params": [ "fb" ] }, { "type": "avg" } ]`,
+			orderBy:   `[{ "column": "avg_fb", "direction": "DESC" }, { "column": "avg_fa" }]`,
+			want:      `SELECT ` + timeBucket + ` AS time, avg("fa"), avg("fb")` + from + ` ORDER BY avg("fb") DESC, avg("fa"), time ASC LIMIT 1000`,
+		},
+		{
+			name:      "ambiguous name",
+			selectors: `[ { "type": "field", "params": [ "fa" ] }, { "type": "avg" } ], [ { "type": "field", "params": [ "fb" ] }, { "type": "avg" } ]`,
+			orderBy:   `[{ "column": "avg" }]`,
+			wantErr:   `cannot order by "avg", it is not selected, available columns are: time, host, avg_fa, avg_fb`,
+		},
+		{
+			name:      "raw query",
+			selectors: `[ { "type": "field", "params": [ "fa" ] } ]`,
+			orderBy:   `[{ "column": "avg" }], "rawQuery": true, "queryText": "SELECT 1"`,
+			want:      "SELECT 1",
+		},
+		{
+			name:    "not selected",
+			orderBy: `[{ "column": "fa; DROP TABLE mq" }]`,
+			wantErr: `cannot order by "fa; DROP TABLE mq", it is not selected, available columns are: time, host, avg, peak "b"`,
+		},
+		{name: "invalid direction", orderBy: `[{ "column": "avg", "direction": "up" }]`, wantErr: `invalid order direction "up" of "avg"`},
+		{name: "invalid nulls", orderBy: `[{ "column": "avg", "nulls": "middle" }]`, wantErr: `invalid nulls order "middle" of "avg", use FIRST or LAST`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel := tt.selectors
+			if sel == "" {
+				sel = selectors
+			}
+			sql, err := buildQuery(t, query(sel, tt.orderBy), plugin.CnosdbDataSourceOptions{}, nil)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, sql)
+		})
+	}
+}
+
+func TestBuildSubqueryAndJoin(t *testing.T) {
+	const timeFilter = ` WHERE time >= 1665360000000000000 AND time <= 1665964800000000000`
+	const minute = `DATE_BIN(INTERVAL '1 minute', time, TIMESTAMP '1970-01-01T00:00:00Z')`
+	const hour = `DATE_BIN(INTERVAL '1 hour', time, TIMESTAMP '1970-01-01T00:00:00Z')`
+	const used = `SELECT ` + minute + ` AS time, "host", avg("used") AS "used" FROM mem` + timeFilter +
+		` GROUP BY ` + minute + `, "host" ORDER BY time ASC`
+	const total = `SELECT ` + minute + ` AS time, "host", avg("total") AS "total" FROM mem_total` + timeFilter +
+		` GROUP BY ` + minute + `, "host" ORDER BY time ASC`
+	// The columns of unaliased nested queries are qualified by their fields
+	const avgUsed = `SELECT ` + minute + ` AS time, "host", avg("used") AS "avg_used" FROM mem` + timeFilter +
+		` GROUP BY ` + minute + `, "host" ORDER BY time ASC`
+	const avgTotal = `SELECT ` + minute + ` AS time, "host", avg("total") AS "avg_total" FROM mem_total` + timeFilter +
+		` GROUP BY ` + minute + `, "host" ORDER BY time ASC`
+	inner := func(table string, field string) string {
+		return `{
+        "table": "` + table + `",
+        "select": [[ { "type": "field", "params": [ "` + field + `" ] }, { "type": "avg" }, { "type": "alias", "params": [ "` + field + `" ] } ]],
+        "groupBy": [ { "type": "time", "params": [ "1 minute" ] }, { "type": "tag", "params": [ "host" ] } ],
+        "orderByTime": "ASC"
+    }`
+	}
+	unaliased := func(table string, field string) string {
+		return `{
+        "table": "` + table + `",
+        "select": [[ { "type": "field", "params": [ "` + field + `" ] }, { "type": "avg" } ]],
+        "groupBy": [ { "type": "time", "params": [ "1 minute" ] }, { "type": "tag", "params": [ "host" ] } ],
+        "orderByTime": "ASC"
+    }`
+	}
+
+	tests := []struct {
+		name    string
+		request string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "subquery",
+			request: `{
+    "subquery": ` + inner("mem", "used") + `,
+    "select": [[ { "type": "field", "params": [ "used" ] }, { "type": "max" } ]],
+    "groupBy": [ { "type": "time", "params": [ "1 hour" ] }, { "type": "tag", "params": [ "host" ] } ],
+    "orderByTime": "ASC"
+}`,
+			want: `SELECT ` + hour + ` AS time, max("used") FROM (` + used + `)` + timeFilter +
+				` GROUP BY ` + hour + `, "host" ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name: "ratio of joined queries",
+			request: `{
+    "subquery": ` + inner("mem", "used") + `,
+    "join": { "query": ` + inner("mem_total", "total") + `, "using": [ "time", "host" ] },
+    "select": [
+        [ { "type": "field", "params": [ "host" ] } ],
+        [ { "type": "field", "params": [ "used" ] }, { "type": "math", "params": [ " / total" ] }, { "type": "alias", "params": [ "ratio" ] } ]
+    ],
+    "orderByTime": "ASC"
+}`,
+			want: `SELECT time, "host", "used" / "total" AS "ratio" FROM (` + used + `) INNER JOIN (` + total + `) USING (time, "host")` +
+				timeFilter + ` ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name: "ratio of unaliased queries",
+			request: `{
+    "subquery": ` + unaliased("mem", "used") + `,
+    "join": { "query": ` + unaliased("mem_total", "total") + `, "using": [ "time", "host" ] },
+    "select": [[ { "type": "field", "params": [ "avg_used" ] }, { "type": "math", "params": [ " / avg_total" ] }, { "type": "alias", "params": [ "ratio" ] } ]],
+    "orderByTime": "ASC"
+}`,
+			want: `SELECT time, "avg_used" / "avg_total" AS "ratio" FROM (` + avgUsed + `) INNER JOIN (` + avgTotal + `) USING (time, "host")` +
+				timeFilter + ` ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name: "joined queries with the same columns",
+			request: `{
+    "subquery": ` + unaliased("mem", "used") + `,
+    "join": { "query": ` + unaliased("mem_total", "used") + `, "using": [ "time", "host" ] },
+    "select": [[ { "type": "field", "params": [ "avg_used" ] } ]]
+}`,
+			wantErr: `column "avg_used" is selected by both joined queries, alias it or add it to the join columns`,
+		},
+		{
+			name:    "joined queries with the same tags",
+			request: `{ "subquery": ` + inner("mem", "used") + `, "join": { "query": ` + inner("mem_total", "total") + `, "using": [ "time" ] } }`,
+			wantErr: `column "host" is selected by both joined queries, alias it or add it to the join columns`,
+		},
+		{
+			name: "left join of a table",
+			request: `{
+    "table": "mem",
+    "join": { "type": "left", "query": ` + inner("mem_total", "total") + `, "using": [ "time", "host" ] },
+    "select": [[ { "type": "field", "params": [ "used" ] } ], [ { "type": "field", "params": [ "total" ] } ]],
+    "orderByTime": "ASC"
+}`,
+			want: `SELECT time, "used", "total" FROM mem LEFT JOIN (` + total + `) USING (time, "host")` + timeFilter + ` ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:    "join without time",
+			request: `{ "table": "mem", "join": { "query": ` + inner("mem_total", "total") + `, "using": [ "host" ] } }`,
+			wantErr: `a join must be on time, add time to the join columns`,
+		},
+		{
+			name:    "table and subquery",
+			request: `{ "table": "mem", "subquery": ` + inner("mem", "used") + `, "select": [[ { "type": "field", "params": [ "used" ] } ]] }`,
+			wantErr: `a query selects from either table "mem" or a subquery`,
+		},
+		{
+			name:    "invalid join type",
+			request: `{ "table": "mem", "join": { "type": "cross", "query": ` + inner("mem_total", "total") + `, "using": [ "host" ] } }`,
+			wantErr: `invalid join type "cross", use INNER, LEFT, RIGHT or FULL`,
+		},
+		{
+			name:    "join without columns",
+			request: `{ "table": "mem", "join": { "query": ` + inner("mem_total", "total") + ` } }`,
+			wantErr: `a join needs the time or tag columns to join on`,
+		},
+		{
+			name:    "invalid subquery",
+			request: `{ "subquery": { "table": "mem", "limit": "x" } }`,
+			wantErr: `subquery: invalid limit "x"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, err := buildQuery(t, tt.request, plugin.CnosdbDataSourceOptions{}, nil)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, sql)
+		})
+	}
+}
+
+func TestBuildHaving(t *testing.T) {
+	const selectors = `[ { "type": "field", "params": [ "usage" ] }, { "type": "avg" } ],
+        [ { "type": "field", "params": [ "usage" ] }, { "type": "max" }, { "type": "math", "params": [ "* 100" ] }, { "type": "alias", "params": [ "peak" ] } ]`
+	query := func(selectors string, having string) string {
+		return `{
+    "table": "cpu",
+    "select": [` + selectors + `],
+    "groupBy": [ { "type": "time", "params": [ "1 hour" ] }, { "type": "tag", "params": [ "host" ] } ],
+    "orderByTime": "ASC",
+    "having": ` + having + `
+}`
+	}
+	const timeBucket = `DATE_BIN(INTERVAL '1 hour', time, TIMESTAMP '1970-01-01T00:00:00Z')`
+	const from = ` FROM cpu WHERE time >= 1665360000000000000 AND time <= 1665964800000000000 GROUP BY ` + timeBucket + `, "host"`
+	const selectFrom = `SELECT ` + timeBucket + ` AS time, avg("usage"), max("usage") * 100 AS "peak"` + from
+
+	tests := []struct {
+		name      string
+		selectors string
+		having    string
+		want      string
+		wantErr   string
+	}{
+		{
+			name:   "aggregate",
+			having: `[{ "column": "avg", "operator": ">", "value": "80" }]`,
+			want:   selectFrom + ` HAVING avg("usage") > 80 ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:   "alias and conditions",
+			having: `[{ "column": "avg", "value": "1.5" }, { "column": "peak", "operator": "<=", "value": "-2", "condition": "or" }]`,
+			want:   selectFrom + ` HAVING avg("usage") = 1.5 OR max("usage") * 100 <= -2 ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:      "selectors with the same name",
+			selectors: `[ { "type": "field", "params": [ "usage" ] }, { "type": "avg" } ], [ { "type": "field", "params": [ "idle" ] }, { "type": "avg" } ]`,
+			having:    `[{ "column": "avg_idle", "operator": "<", "value": "10" }, { "column": "avg_usage", "operator": ">", "value": "80" }]`,
+			want: `SELECT ` + timeBucket + ` AS time, avg("usage"), avg("idle")` + from +
+				` HAVING avg("idle") < 10 AND avg("usage") > 80 ORDER BY time ASC LIMIT 1000`,
+		},
+		{
+			name:      "ambiguous name",
+			selectors: `[ { "type": "field", "params": [ "usage" ] }, { "type": "avg" } ], [ { "type": "field", "params": [ "idle" ] }, { "type": "avg" } ]`,
+			having:    `[{ "column": "avg", "operator": ">", "value": "80" }]`,
+			wantErr:   `cannot filter by "avg", it is not selected, available aggregates are: avg_usage, avg_idle`,
+		},
+		{
+			name:      "raw query",
+			selectors: `[ { "type": "field", "params": [ "idle" ] } ]`,
+			having:    `[{ "column": "avg", "operator": ">", "value": "80" }], "rawQuery": true, "queryText": "SELECT 1"`,
+			want:      "SELECT 1",
+		},
+		{
+			name:    "not selected",
+			having:  `[{ "column": "min", "operator": ">", "value": "1" }]`,
+			wantErr: `cannot filter by "min", it is not selected, available aggregates are: avg, peak`,
+		},
+		{
+			name:      "not an aggregate",
+			selectors: `[ { "type": "field", "params": [ "idle" ] } ]`,
+			having:    `[{ "column": "idle", "operator": ">", "value": "1" }]`,
+			wantErr:   `cannot filter by "idle", it is not an aggregate`,
+		},
+		{
+			name:    "invalid operator",
+			having:  `[{ "column": "avg", "operator": "=~", "value": "1" }]`,
+			wantErr: `invalid operator "=~" of "avg"`,
+		},
+		{
+			name:    "invalid value",
+			having:  `[{ "column": "avg", "operator": ">", "value": "1 OR 1=1" }]`,
+			wantErr: `invalid value "1 OR 1=1" of "avg", use a number`,
+		},
+		{
+			name:    "invalid condition",
+			having:  `[{ "column": "avg", "value": "1" }, { "column": "peak", "value": "1", "condition": "XOR" }]`,
+			wantErr: `invalid condition "XOR" of "peak", use AND or OR`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel := tt.selectors
+			if sel == "" {
+				sel = selectors
+			}
+			sql, err := buildQuery(t, query(sel, tt.having), plugin.CnosdbDataSourceOptions{}, nil)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, sql)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// OrderByItem is a sort key of a query, Column is the time, a GROUP BY tag or the name of a selector,
+// i.e. its alias or its default name, e.g. "avg" for `field(fa), avg()`, see selectorColumnNames.
+type OrderByItem struct {
+	Column    string `json:"column"`
+	Direction string `json:"direction,omitempty"`
+	Nulls     string `json:"nulls,omitempty"`
+}
+
+// quoteIdentifier quotes a column name, quotes in the name are escaped by doubling them.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// outputColumns returns the names of the columns of the query result.
+func (query *QueryModel) outputColumns() []string {
+	columns := []string{ColumnTime}
+	for _, group := range query.GroupBy {
+		if group.Type == "tag" {
+			columns = append(columns, group.Params[0])
+		}
+	}
+	return append(columns, query.selectorColumnNames()...)
+}
+
+// validateOrderBy checks that the sort keys are result columns with a valid direction and null ordering.
+func (query *QueryModel) validateOrderBy() error {
+	columns := query.outputColumns()
+	for _, item := range query.OrderBy {
+		found := false
+		for _, column := range columns {
+			if item.Column == column {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("cannot order by %q, it is not selected, available columns are: %s", item.Column, strings.Join(columns, ", "))
+		}
+		switch strings.ToUpper(item.Direction) {
+		case "", "ASC", "DESC":
+		default:
+			return fmt.Errorf("invalid order direction %q of %q", item.Direction, item.Column)
+		}
+		switch strings.ToUpper(item.Nulls) {
+		case "", "FIRST", "LAST":
+		default:
+			return fmt.Errorf("invalid nulls order %q of %q, use FIRST or LAST", item.Nulls, item.Column)
+		}
+	}
+	return nil
+}
+
+// renderOrderBy renders the sort keys of OrderBy followed by the time ordered by OrderByTime, if
+// the time is not a sort key. Selectors without alias are sorted by their expression unless the
+// columns are named, see namesColumns.
+func (query *QueryModel) renderOrderBy(dataQuery *backend.DataQuery) string {
+	if len(query.OrderBy) == 0 {
+		return query.renderOrderByTime()
+	}
+
+	expressions := map[string]string{}
+	if !query.namesColumns() && !query.hasWindowFunctions() {
+		for i, name := range query.selectorColumnNames() {
+			if _, ok := selectorAlias(query.Select[i]); !ok {
+				expressions[name] = query.renderSelector(dataQuery, query.Select[i])
+			}
+		}
+	}
+
+	var keys []string
+	orderedByTime := false
+	for _, item := range query.OrderBy {
+		key := quoteIdentifier(item.Column)
+		if item.Column == ColumnTime {
+			key = ColumnTime
+			orderedByTime = true
+		} else if expr, ok := expressions[item.Column]; ok {
+			key = expr
+		}
+		if item.Direction != "" {
+			key += " " + strings.ToUpper(item.Direction)
+		}
+		if item.Nulls != "" {
+			key += " NULLS " + strings.ToUpper(item.Nulls)
+		}
+		keys = append(keys, key)
+	}
+	if !orderedByTime && query.OrderByTime != "" {
+		keys = append(keys, fmt.Sprintf("%s %s", ColumnTime, query.OrderByTime))
+	}
+	return " ORDER BY " + strings.Join(keys, ", ")
+}
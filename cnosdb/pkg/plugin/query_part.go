@@ -4,85 +4,269 @@ import "github.com/grafana/grafana-plugin-sdk-go/backend"
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 var renders map[string]QueryDefinition
 
+const (
+	ParamTypeString = "string"
+	ParamTypeInt    = "int"
+	ParamTypeFloat  = "float"
+	ParamTypeTime   = "time"
+	ParamTypeMath   = "math"
+)
+
+var (
+	regexpIntervalParam = regexp.MustCompile(`^\d+\s*[a-zA-Z]+$`)
+	// A math operand is a number or a column, e.g. the column of a joined query
+	regexpMathParam = regexp.MustCompile(`^\s*([-+*/])\s*(-?\d+(\.\d+)?|[A-Za-z_][A-Za-z0-9_]*|"(?:[^"]|"")+")\s*$`)
+)
+
 type DefinitionParameters struct {
-	Name string
-	Type string
+	Name     string
+	Type     string
+	Optional bool
+	// Positive requires a number parameter to be greater than 0
+	Positive bool
 }
 
 type QueryDefinition struct {
-	Renderer func(query *QueryModel, queryContext *backend.QueryDataRequest, part *SelectItem, innerExpr string) string
+	Renderer func(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string
 	Params   []DefinitionParameters
+	// Window is true for window functions, which are applied on the time buckets of each series.
+	Window bool
 }
 
 func init() {
 	renders = make(map[string]QueryDefinition)
 
-	renders["field"] = QueryDefinition{Renderer: fieldRenderer}
+	renders["field"] = QueryDefinition{
+		Renderer: fieldRenderer,
+		Params:   []DefinitionParameters{{Name: "field", Type: ParamTypeString}},
+	}
 
+	// Aggregations
 	renders["avg"] = QueryDefinition{Renderer: functionRenderer}
 	renders["count"] = QueryDefinition{Renderer: functionRenderer}
+	renders["distinct"] = QueryDefinition{Renderer: distinctRenderer}
 	renders["min"] = QueryDefinition{Renderer: functionRenderer}
 	renders["max"] = QueryDefinition{Renderer: functionRenderer}
 	renders["sum"] = QueryDefinition{Renderer: functionRenderer}
 	renders["stddev"] = QueryDefinition{Renderer: functionRenderer}
 	renders["variance"] = QueryDefinition{Renderer: functionRenderer}
+	renders["median"] = QueryDefinition{Renderer: functionRenderer}
+	renders["mode"] = QueryDefinition{Renderer: functionRenderer}
+	renders["spread"] = QueryDefinition{Renderer: functionRenderer}
+
+	// Selectors
+	renders["first"] = QueryDefinition{Renderer: timeFunctionRenderer}
+	renders["last"] = QueryDefinition{Renderer: timeFunctionRenderer}
+	renders["percentile_cont"] = QueryDefinition{
+		Renderer: percentileContRenderer,
+		Params:   []DefinitionParameters{{Name: "percentile", Type: ParamTypeFloat}},
+	}
+	renders["approx_percentile"] = QueryDefinition{
+		Renderer: approxPercentileRenderer,
+		Params:   []DefinitionParameters{{Name: "percentile", Type: ParamTypeFloat}},
+	}
+
+	// Transformations
+	renders["derivative"] = QueryDefinition{
+		Renderer: derivativeRenderer,
+		Window:   true,
+		Params:   []DefinitionParameters{{Name: "unit", Type: ParamTypeTime, Optional: true}},
+	}
+	renders["non_negative_derivative"] = QueryDefinition{
+		Renderer: nonNegativeDerivativeRenderer,
+		Window:   true,
+		Params:   []DefinitionParameters{{Name: "unit", Type: ParamTypeTime, Optional: true}},
+	}
+	renders["difference"] = QueryDefinition{Renderer: differenceRenderer, Window: true}
+	renders["moving_average"] = QueryDefinition{
+		Renderer: movingAverageRenderer,
+		Window:   true,
+		Params:   []DefinitionParameters{{Name: "window", Type: ParamTypeInt, Positive: true}},
+	}
+	renders["cumulative_sum"] = QueryDefinition{Renderer: cumulativeSumRenderer, Window: true}
+	renders["rate"] = QueryDefinition{Renderer: rateRenderer, Window: true}
+	renders["increase"] = QueryDefinition{Renderer: increaseRenderer, Window: true}
+
+	// Math
+	renders["math"] = QueryDefinition{
+		Renderer: suffixRenderer,
+		Params:   []DefinitionParameters{{Name: "expr", Type: ParamTypeMath}},
+	}
 
 	renders["time"] = QueryDefinition{
 		Renderer: timeRenderer,
-		Params:   []DefinitionParameters{{Name: "interval", Type: "time"}, {Name: "offset", Type: "time"}},
+		Params:   []DefinitionParameters{{Name: "interval", Type: ParamTypeTime}, {Name: "offset", Type: ParamTypeTime, Optional: true}},
 	}
 
 	renders["fill"] = QueryDefinition{
 		Renderer: emptyRenderer,
-		Params:   []DefinitionParameters{{Name: "fill", Type: "string"}},
+		Params:   []DefinitionParameters{{Name: "fill", Type: ParamTypeString}},
 	}
 
 	renders["tag"] = QueryDefinition{
 		Renderer: fieldRenderer,
-		Params:   []DefinitionParameters{{Name: "tag", Type: "string"}},
+		Params:   []DefinitionParameters{{Name: "tag", Type: ParamTypeString}},
+	}
+
+	renders["alias"] = QueryDefinition{
+		Renderer: aliasRenderer,
+		Params:   []DefinitionParameters{{Name: "name", Type: ParamTypeString}},
+	}
+}
+
+// Validate checks the number and the types of the parameters of part.
+func (def *QueryDefinition) Validate(part *SelectItem) error {
+	required := 0
+	for _, p := range def.Params {
+		if !p.Optional {
+			required++
+		}
+	}
+	if len(part.Params) < required || len(part.Params) > len(def.Params) {
+		if required == len(def.Params) {
+			return fmt.Errorf("%s: expected %d parameter(s), got %d", part.Type, required, len(part.Params))
+		}
+		return fmt.Errorf("%s: expected %d to %d parameters, got %d", part.Type, required, len(def.Params), len(part.Params))
+	}
+
+	for i, param := range part.Params {
+		paramDef := def.Params[i]
+		var valid bool
+		switch paramDef.Type {
+		case ParamTypeInt:
+			n, err := strconv.ParseInt(param, 10, 64)
+			valid = err == nil && (!paramDef.Positive || n > 0)
+		case ParamTypeFloat:
+			f, err := strconv.ParseFloat(param, 64)
+			valid = err == nil && (!paramDef.Positive || f > 0)
+		case ParamTypeTime:
+			valid = param == IntervalAuto || regexpIntervalParam.MatchString(strings.TrimSpace(param))
+		case ParamTypeMath:
+			valid = regexpMathParam.MatchString(param)
+		default:
+			valid = param != ""
+		}
+		if !valid {
+			return fmt.Errorf("%s: invalid %s parameter %q", part.Type, paramDef.Name, param)
+		}
 	}
 
-	renders["alias"] = QueryDefinition{Renderer: aliasRenderer}
+	return nil
 }
 
-func fieldRenderer(query *QueryModel, queryContext *backend.QueryDataRequest, part *SelectItem, innerExpr string) string {
+func fieldRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
 	if part.Params[0] == "*" {
 		return "*"
 	}
 	return fmt.Sprintf(`"%s"`, part.Params[0])
 }
 
-func timeRenderer(query *QueryModel, queryContext *backend.QueryDataRequest, part *SelectItem, innerExpr string) string {
+func timeRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
 	if query.Interval == "" {
 		return "time"
 	} else {
-		return fmt.Sprintf("DATE_BIN(INTERVAL '%s', time, TIMESTAMP '1970-01-01T00:00:00Z')", query.Interval)
+		return query.renderTimeBucket()
 	}
 }
 
-func functionRenderer(query *QueryModel, queryContext *backend.QueryDataRequest, part *SelectItem, innerExpr string) string {
+func functionRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	params := part.Params
 	if innerExpr != "" {
-		part.Params = append([]string{innerExpr}, part.Params...)
+		params = append([]string{innerExpr}, params...)
 	}
 
-	params := strings.Join(part.Params, ", ")
+	return fmt.Sprintf("%s(%s)", part.Type, strings.Join(params, ", "))
+}
 
-	return fmt.Sprintf("%s(%s)", part.Type, params)
+// timeFunctionRenderer renders selectors which take the time column as first argument, e.g. first(time, "fa").
+func timeFunctionRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	return fmt.Sprintf("%s(time, %s)", part.Type, innerExpr)
 }
 
-func suffixRenderer(query *QueryModel, queryContext *backend.QueryDataRequest, part *SelectItem, innerExpr string) string {
-	return fmt.Sprintf("%s %s", innerExpr, part.Params[0])
+func distinctRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	return fmt.Sprintf("DISTINCT %s", innerExpr)
+}
+
+func percentileContRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	return fmt.Sprintf("percentile_cont(%s) WITHIN GROUP (ORDER BY %s)", part.Params[0], innerExpr)
+}
+
+func approxPercentileRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	return fmt.Sprintf("approx_percentile_cont(%s, %s)", innerExpr, part.Params[0])
+}
+
+// derivativeExpr renders the change of innerExpr per unit (default 1 second) between two rows.
+func derivativeExpr(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	unit := "1 second"
+	if len(part.Params) > 0 {
+		unit = part.Params[0]
+	}
+	unitInterval, err := ParseMacroInterval(unit)
+	if err != nil {
+		unitInterval = time.Second
+	}
+	unitNanos := unitInterval.Nanoseconds()
+	over := windowOver(query, dataQuery, "")
+	timeExpr := fmt.Sprintf("CAST(%s AS BIGINT)", ColumnTime)
+	return fmt.Sprintf("(%s - lag(%s) %s) * %d / (%s - lag(%s) %s)", innerExpr, innerExpr, over, unitNanos, timeExpr, timeExpr, over)
+}
+
+func derivativeRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	return derivativeExpr(query, dataQuery, part, innerExpr)
+}
+
+func nonNegativeDerivativeRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	over := windowOver(query, dataQuery, "")
+	return fmt.Sprintf("CASE WHEN %s >= lag(%s) %s THEN %s END", innerExpr, innerExpr, over, derivativeExpr(query, dataQuery, part, innerExpr))
+}
+
+func differenceRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	return fmt.Sprintf("%s - lag(%s) %s", innerExpr, innerExpr, windowOver(query, dataQuery, ""))
+}
+
+func movingAverageRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	n, _ := strconv.ParseInt(part.Params[0], 10, 64)
+	frame := fmt.Sprintf("ROWS BETWEEN %d PRECEDING AND CURRENT ROW", n-1)
+	return fmt.Sprintf("avg(%s) %s", innerExpr, windowOver(query, dataQuery, frame))
+}
+
+func cumulativeSumRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	frame := "ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW"
+	return fmt.Sprintf("sum(%s) %s", innerExpr, windowOver(query, dataQuery, frame))
+}
+
+// rateRenderer renders the per-second increase of a counter, resets are ignored.
+func rateRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	return nonNegativeDerivativeRenderer(query, dataQuery, &SelectItem{Type: part.Type}, innerExpr)
+}
+
+// increaseRenderer renders the increase of a counter between two rows, resets are ignored.
+func increaseRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	over := windowOver(query, dataQuery, "")
+	return fmt.Sprintf("CASE WHEN %s >= lag(%s) %s THEN %s - lag(%s) %s END", innerExpr, innerExpr, over, innerExpr, innerExpr, over)
+}
+
+func suffixRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	match := regexpMathParam.FindStringSubmatch(part.Params[0])
+	if match != nil && (match[2][0] == '_' || unicode.IsLetter(rune(match[2][0]))) {
+		return fmt.Sprintf("%s %s %s", innerExpr, match[1], quoteIdentifier(match[2]))
+	}
+	return fmt.Sprintf("%s %s", innerExpr, strings.TrimSpace(part.Params[0]))
 }
 
-func aliasRenderer(query *QueryModel, queryContext *backend.QueryDataRequest, part *SelectItem, innerExpr string) string {
-	return fmt.Sprintf(`%s AS "%s"`, innerExpr, part.Params[0])
+func aliasRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
+	return fmt.Sprintf("%s AS %s", innerExpr, quoteIdentifier(part.Params[0]))
 }
 
-func emptyRenderer(query *QueryModel, queryContext *backend.QueryDataRequest, part *SelectItem, innerExpr string) string {
+func emptyRenderer(query *QueryModel, dataQuery *backend.DataQuery, part *SelectItem, innerExpr string) string {
 	return ""
 }
@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Window functions need the aggregated rows of each series ordered by time, so a query with
+// a window function is rendered in two stages:
+//
+//	SELECT time, "tag", derivative("_v0") AS "derivative" FROM (
+//	  SELECT DATE_BIN(...) AS time, "tag", avg("fa") AS "_v0" FROM ... GROUP BY DATE_BIN(...), "tag"
+//	) ORDER BY time ASC LIMIT 1000
+//
+// The window functions of the outer query are partitioned by the GROUP BY tags.
+
+// hasWindowFunctions returns true if any selector uses a window function.
+func (query *QueryModel) hasWindowFunctions() bool {
+	for _, sel := range query.Select {
+		if windowPartIndex(sel) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWindowParts checks that only window functions, math and aliases follow a window function.
+func validateWindowParts(sel []*SelectItem) error {
+	idx := windowPartIndex(sel)
+	if idx < 0 {
+		return nil
+	}
+	for _, s := range sel[idx+1:] {
+		if !s.Def.Window && s.Type != "math" && s.Type != "alias" {
+			return fmt.Errorf("%s cannot be applied after %s", s.Type, sel[idx].Type)
+		}
+	}
+	return nil
+}
+
+func windowPartIndex(sel []*SelectItem) int {
+	for i, s := range sel {
+		if s.Def != nil && s.Def.Window {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitWindowParts splits a selector into the parts rendered by the inner query
+// and the parts rendered by the outer query.
+func splitWindowParts(sel []*SelectItem) ([]*SelectItem, []*SelectItem) {
+	idx := windowPartIndex(sel)
+	if idx >= 0 {
+		return sel[:idx], sel[idx:]
+	}
+	if len(sel) > 0 && sel[len(sel)-1].Type == "alias" {
+		return sel[:len(sel)-1], sel[len(sel)-1:]
+	}
+	return sel, nil
+}
+
+// windowColumnName returns the name of a selector without alias, e.g. "derivative" for
+// `field(fa), avg(), derivative()`, or "fa" for `field(fa)`.
+func windowColumnName(sel []*SelectItem) string {
+	for i := len(sel) - 1; i >= 0; i-- {
+		switch sel[i].Type {
+		case "alias", "math":
+			continue
+		case "field":
+			return sel[i].Params[0]
+		default:
+			return sel[i].Type
+		}
+	}
+	return ""
+}
+
+func (query *QueryModel) renderGroupByTags(dataQuery *backend.DataQuery) []string {
+	var tags []string
+	for _, group := range query.GroupBy {
+		if group.Type == "tag" {
+			tags = append(tags, group.Render(query, dataQuery, ""))
+		}
+	}
+	return tags
+}
+
+func (query *QueryModel) renderWindowQuery(dataQuery *backend.DataQuery) string {
+	tags := query.renderGroupByTags(dataQuery)
+
+	innerSelectors := append([]string{query.renderTimeSelector()}, tags...)
+	outerSelectors := append([]string{ColumnTime}, tags...)
+	names := query.selectorColumnNames()
+	for i, sel := range query.Select {
+		innerParts, outerParts := splitWindowParts(sel)
+		column := fmt.Sprintf(`"_v%d"`, i)
+
+		stk := ""
+		for _, s := range innerParts {
+			stk = s.Render(query, dataQuery, stk)
+		}
+		innerSelectors = append(innerSelectors, fmt.Sprintf("%s AS %s", stk, column))
+
+		stk = column
+		for _, s := range outerParts {
+			stk = s.Render(query, dataQuery, stk)
+		}
+		if len(outerParts) == 0 || outerParts[len(outerParts)-1].Type != "alias" {
+			stk = fmt.Sprintf("%s AS %s", stk, quoteIdentifier(names[i]))
+		}
+		outerSelectors = append(outerSelectors, stk)
+	}
+
+	inner := "SELECT " + strings.Join(innerSelectors, ", ")
+	inner += query.renderMeasurement()
+	inner += query.renderWhereClause()
+	inner += query.renderTimeFilter(dataQuery)
+	inner += query.renderGroupBy(dataQuery)
+	inner += query.renderHaving(dataQuery)
+
+	res := "SELECT " + strings.Join(outerSelectors, ", ")
+	res += fmt.Sprintf(" FROM (%s)", inner)
+	if query.hasSeriesLimits() {
+		res = query.renderSeriesLimits(dataQuery, res)
+	}
+	res += query.renderOrderBy(dataQuery)
+	res += query.renderLimit()
+	return res
+}
+
+// windowOver returns the window clause of the outer query, which orders the rows
+// of each series by time.
+func windowOver(query *QueryModel, dataQuery *backend.DataQuery, frame string) string {
+	res := "OVER ("
+	if tags := query.renderGroupByTags(dataQuery); len(tags) > 0 {
+		res += fmt.Sprintf("PARTITION BY %s ", strings.Join(tags, ", "))
+	}
+	res += "ORDER BY " + ColumnTime
+	if frame != "" {
+		res += " " + frame
+	}
+	return res + ")"
+}
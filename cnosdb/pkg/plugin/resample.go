@@ -91,8 +91,10 @@ func Resample(f *data.Frame, interval time.Duration, timeRange backend.TimeRange
 	lastSeenRowIdx := -1
 	timeField := f.Fields[tsSchema.TimeIndex]
 
-	startUnixTime := timeRange.From.Unix() / int64(interval.Seconds()) * int64(interval.Seconds())
-	startTime := time.Unix(startUnixTime, 0)
+	// The first bucket starts at the multiple of the interval since the epoch, like DATE_BIN,
+	// intervals shorter than a second are aligned too
+	startUnixNano := timeRange.From.UnixNano()
+	startTime := time.Unix(0, startUnixNano-startUnixNano%int64(interval))
 
 	for currentTime := startTime; !currentTime.After(timeRange.To); currentTime = currentTime.Add(interval) {
 		initialRowIdx := 0
@@ -1,5 +1,11 @@
 package plugin
 
+import (
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
 type ResponseRow struct {
 	Time   string  `json:"time,omitempty"`
 	Metric string  `json:"metric,omitempty"`
@@ -11,3 +17,37 @@ type Array struct {
 	float64Array []*float64
 	boolArray    []*bool
 }
+
+// FrameMetaCustom is the plugin specific metadata of a frame, shown in the query inspector.
+type FrameMetaCustom struct {
+	Interval   string `json:"interval,omitempty"`
+	IntervalMs int64  `json:"intervalMs,omitempty"`
+}
+
+func NewFrameMetaCustom(query *QueryModel) *FrameMetaCustom {
+	interval := query.ResolvedInterval()
+	if interval == 0 {
+		return &FrameMetaCustom{}
+	}
+	return &FrameMetaCustom{
+		Interval:   FormatIntervalString(interval),
+		IntervalMs: interval.Milliseconds(),
+	}
+}
+
+// QueryStats records the cost of a query, shown in the query inspector as frame stats.
+type QueryStats struct {
+	Latency       time.Duration
+	BytesReceived int
+	RowsDecoded   int
+	ResampleTime  time.Duration
+}
+
+func (s *QueryStats) FrameStats() []data.QueryStat {
+	return []data.QueryStat{
+		{FieldConfig: data.FieldConfig{DisplayName: "Round-trip latency", Unit: "ms"}, Value: float64(s.Latency.Microseconds()) / 1000},
+		{FieldConfig: data.FieldConfig{DisplayName: "Bytes received", Unit: "decbytes"}, Value: float64(s.BytesReceived)},
+		{FieldConfig: data.FieldConfig{DisplayName: "Rows decoded"}, Value: float64(s.RowsDecoded)},
+		{FieldConfig: data.FieldConfig{DisplayName: "Resample time", Unit: "ms"}, Value: float64(s.ResampleTime.Microseconds()) / 1000},
+	}
+}
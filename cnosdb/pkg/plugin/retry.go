@@ -0,0 +1,166 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	DefaultRetryAttempts = 3
+	DefaultRetryBackoff  = 100 * time.Millisecond
+	DefaultRetryTimeout  = 30 * time.Second
+	MaxRetryBackoff      = 5 * time.Second
+)
+
+type idempotentKey struct{}
+
+// withIdempotent marks a request as safe to be sent more than once, e.g. a SELECT sent by POST.
+func withIdempotent(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), idempotentKey{}, true))
+}
+
+func isIdempotent(req *http.Request) bool {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return true
+	}
+	idempotent, _ := req.Context().Value(idempotentKey{}).(bool)
+	return idempotent
+}
+
+// RetryOptions configures how transient failures of CnosDB are retried.
+type RetryOptions struct {
+	// Attempts is the maximum number of times a request is sent, 1 disables retries.
+	Attempts int
+	// Backoff is the initial backoff, it is doubled for each retry up to MaxRetryBackoff.
+	Backoff time.Duration
+	// Timeout is the total time spent on a request including retries.
+	Timeout time.Duration
+}
+
+// RetryTransport retries idempotent requests on connection errors, 502, 503, 504 and 429 responses,
+// with jittered exponential backoff. The Retry-After header of a response is honoured.
+type RetryTransport struct {
+	next    http.RoundTripper
+	options RetryOptions
+}
+
+func NewRetryTransport(next http.RoundTripper, options RetryOptions) *RetryTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if options.Attempts <= 0 {
+		options.Attempts = DefaultRetryAttempts
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = DefaultRetryBackoff
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultRetryTimeout
+	}
+	return &RetryTransport{next: next, options: options}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.options.Attempts <= 1 || !isIdempotent(req) || (req.Body != nil && req.GetBody == nil) {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	deadline := time.Now().Add(t.options.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err := t.next.RoundTrip(req)
+		if attempt >= t.options.Attempts || !shouldRetry(ctx, res, err) {
+			return res, err
+		}
+
+		wait := t.backoff(attempt)
+		if res != nil {
+			if retryAfter, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+				wait = retryAfter
+			}
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return res, err
+		}
+		if res != nil {
+			// Drain the body so that the connection can be reused.
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		log.DefaultLogger.Debug("Retrying CnosDB request", "attempt", attempt, "wait", wait, "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// backoff returns a random wait in [b/2, b] of b = Backoff * 2^(attempt-1), limited by MaxRetryBackoff.
+// Half of the backoff is kept, so that retries are spread but never sent right away.
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	backoff := t.options.Backoff
+	for i := 1; i < attempt && backoff < MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxRetryBackoff {
+		backoff = MaxRetryBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff-backoff/2)+1))
+}
+
+func shouldRetry(ctx context.Context, res *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// A failed TLS handshake fails again
+		return !isTLSError(err)
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseRetryAfter parses the Retry-After header, which is either seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,139 @@
+package plugin_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cnosdb/cnos-cnosdb-datasource-backend/pkg/plugin"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFlakyServer returns a server failing the first failures requests with status.
+func newFlakyServer(t *testing.T, failures int32, status int, header http.Header) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt32(&requests, 1) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestRetryTransport(t *testing.T) {
+	for _, status := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests} {
+		server, requests := newFlakyServer(t, 2, status, nil)
+		client := &http.Client{Transport: plugin.NewRetryTransport(nil, plugin.RetryOptions{Attempts: 3, Backoff: time.Millisecond})}
+
+		res, err := client.Get(server.URL)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+	}
+}
+
+func TestRetryTransportAttempts(t *testing.T) {
+	server, requests := newFlakyServer(t, 5, http.StatusServiceUnavailable, nil)
+	client := &http.Client{Transport: plugin.NewRetryTransport(nil, plugin.RetryOptions{Attempts: 2, Backoff: time.Millisecond})}
+
+	res, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+}
+
+func TestRetryTransportNotRetried(t *testing.T) {
+	// Client errors are not transient
+	server, requests := newFlakyServer(t, 1, http.StatusUnprocessableEntity, nil)
+	client := &http.Client{Transport: plugin.NewRetryTransport(nil, plugin.RetryOptions{Attempts: 3, Backoff: time.Millisecond})}
+	res, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	// POST requests are not idempotent unless marked by the datasource
+	server, requests = newFlakyServer(t, 1, http.StatusServiceUnavailable, nil)
+	res, err = client.Post(server.URL, "text/plain", strings.NewReader("INSERT INTO t VALUES (1)"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+}
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	// Retry-After exceeding the budget returns the response without waiting
+	server, requests := newFlakyServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": []string{"60"}})
+	client := &http.Client{Transport: plugin.NewRetryTransport(nil, plugin.RetryOptions{Attempts: 3, Backoff: time.Millisecond, Timeout: time.Second})}
+
+	start := time.Now()
+	res, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+	assert.Less(t, time.Since(start), time.Second)
+
+	server, requests = newFlakyServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": []string{"0"}})
+	res, err = client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+}
+
+func TestRetryTransportContext(t *testing.T) {
+	server, requests := newFlakyServer(t, 5, http.StatusServiceUnavailable, nil)
+	client := &http.Client{Transport: plugin.NewRetryTransport(nil, plugin.RetryOptions{Attempts: 5, Backoff: time.Second})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	start := time.Now()
+	_, _ = client.Do(req)
+	assert.Less(t, time.Since(start), time.Second)
+	// The backoff of at least half a second doesn't fit before the deadline
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+}
+
+func TestQueryDataRetry(t *testing.T) {
+	var requests int32
+	ds := newTestDatasource(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/ping" {
+			_, _ = w.Write([]byte(`{"version":"2.3.0","status":"healthy"}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "SELECT time, value FROM t", string(body))
+		_, _ = w.Write([]byte(`[{"time":"2022-10-10T00:00:00","value":1.5}]`))
+	})
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{Queries: []backend.DataQuery{{
+			RefID: "A",
+			JSON:  []byte(`{"rawQuery":true,"queryText":"SELECT time, value FROM t"}`),
+		}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := resp.Responses["A"]
+	assert.NoError(t, res.Error)
+	assert.Equal(t, 1, res.Frames[0].Rows())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
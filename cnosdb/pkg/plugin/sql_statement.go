@@ -0,0 +1,275 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	StatementSelect   = "SELECT"
+	StatementShow     = "SHOW"
+	StatementDescribe = "DESCRIBE"
+	StatementExplain  = "EXPLAIN"
+)
+
+// DefaultAllowedStatements are the read-only statements allowed if the datasource doesn't configure any.
+var DefaultAllowedStatements = []string{StatementSelect, StatementShow, StatementDescribe, StatementExplain}
+
+// statementAliases maps keywords to the statement type they start.
+var statementAliases = map[string]string{
+	"VALUES": StatementSelect,
+	"DESC":   StatementDescribe,
+}
+
+// SplitStatements splits sql into statements separated by ';', ignoring separators in quoted
+// strings, quoted identifiers and comments. Empty statements are dropped.
+func SplitStatements(sql string) []string {
+	var statements []string
+	start := 0
+	for i := 0; i < len(sql); i++ {
+		switch {
+		case sql[i] == '\'' || sql[i] == '"':
+			i = skipQuoted(sql, i)
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		case sql[i] == ';':
+			statements = appendStatement(statements, sql[start:i])
+			start = i + 1
+		}
+	}
+	return appendStatement(statements, sql[start:])
+}
+
+func appendStatement(statements []string, statement string) []string {
+	if ClassifyStatement(statement) == "" {
+		return statements
+	}
+	return append(statements, strings.TrimSpace(statement))
+}
+
+// skipQuoted returns the position of the quote closing the one at sql[start],
+// doubled quotes are escapes.
+func skipQuoted(sql string, start int) int {
+	quote := sql[start]
+	for i := start + 1; i < len(sql); i++ {
+		if sql[i] == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return len(sql)
+}
+
+func skipLineComment(sql string, start int) int {
+	if end := strings.IndexByte(sql[start:], '\n'); end >= 0 {
+		return start + end
+	}
+	return len(sql)
+}
+
+func skipBlockComment(sql string, start int) int {
+	if end := strings.Index(sql[start+2:], "*/"); end >= 0 {
+		return start + 2 + end + 1
+	}
+	return len(sql)
+}
+
+// ClassifyStatement returns the type of a single statement, which is its first keyword
+// in upper case, e.g. "SELECT" or "DROP". Leading comments and parentheses are skipped.
+// A WITH statement is classified by the statement following its common table expressions,
+// e.g. "INSERT" for `WITH a AS (SELECT 1) INSERT INTO t SELECT * FROM a`, or "WITH" if these
+// can't be parsed. An empty string is returned if the statement has no keyword.
+func ClassifyStatement(statement string) string {
+	keyword, rest := nextKeyword(statement)
+	if keyword == "WITH" {
+		if body, ok := withBody(rest); ok {
+			if statementType := ClassifyStatement(body); statementType != "" {
+				return statementType
+			}
+		}
+		return keyword
+	}
+	if alias, ok := statementAliases[keyword]; ok {
+		return alias
+	}
+	return keyword
+}
+
+// withBody returns the statement following the common table expressions of a WITH statement,
+// rest is the statement after WITH: [RECURSIVE] name [(columns)] AS [[NOT] MATERIALIZED] (query), ...
+func withBody(rest string) (string, bool) {
+	i := skipSpace(rest, 0)
+	if word, end := scanWord(rest, i); word == "RECURSIVE" {
+		i = skipSpace(rest, end)
+	}
+	for {
+		name, end := scanWord(rest, i)
+		if name == "" {
+			return "", false
+		}
+		i = skipSpace(rest, end)
+		if i < len(rest) && rest[i] == '(' {
+			i = skipSpace(rest, skipParens(rest, i))
+		}
+		word, end := scanWord(rest, i)
+		if word != "AS" {
+			return "", false
+		}
+		i = skipSpace(rest, end)
+		for _, option := range []string{"NOT", "MATERIALIZED"} {
+			if word, end := scanWord(rest, i); word == option {
+				i = skipSpace(rest, end)
+			}
+		}
+		if i >= len(rest) || rest[i] != '(' {
+			return "", false
+		}
+		i = skipSpace(rest, skipParens(rest, i))
+		if i < len(rest) && rest[i] == ',' {
+			i = skipSpace(rest, i+1)
+			continue
+		}
+		return rest[i:], true
+	}
+}
+
+// skipSpace returns the position of the first character of sql at or after start which is not
+// white space or in a comment.
+func skipSpace(sql string, start int) int {
+	for i := start; i < len(sql); i++ {
+		switch {
+		case sql[i] == ' ' || sql[i] == '\t' || sql[i] == '\r' || sql[i] == '\n':
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		default:
+			return i
+		}
+	}
+	return len(sql)
+}
+
+// scanWord returns the keyword or identifier at sql[start] in upper case and the position after
+// it, quoted identifiers are returned with their quotes.
+func scanWord(sql string, start int) (string, int) {
+	if start >= len(sql) {
+		return "", start
+	}
+	if sql[start] == '"' {
+		end := skipQuoted(sql, start) + 1
+		if end > len(sql) {
+			end = len(sql)
+		}
+		return sql[start:end], end
+	}
+	end := start
+	for end < len(sql) && isIdentChar(sql[end]) {
+		end++
+	}
+	return strings.ToUpper(sql[start:end]), end
+}
+
+// skipParens returns the position after the parenthesis closing the one at sql[open], skipping
+// quoted strings and comments.
+func skipParens(sql string, open int) int {
+	depth := 0
+	for i := open; i < len(sql); i++ {
+		switch {
+		case sql[i] == '\'' || sql[i] == '"':
+			i = skipQuoted(sql, i)
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		case sql[i] == '(':
+			depth++
+		case sql[i] == ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(sql)
+}
+
+// nextKeyword returns the first keyword of statement in upper case and the statement after it,
+// leading comments and parentheses are skipped.
+func nextKeyword(statement string) (string, string) {
+	for i := 0; i < len(statement); i++ {
+		c := statement[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '(':
+			continue
+		case strings.HasPrefix(statement[i:], "--"):
+			i = skipLineComment(statement, i)
+		case strings.HasPrefix(statement[i:], "/*"):
+			i = skipBlockComment(statement, i)
+		default:
+			end := i
+			for end < len(statement) && isIdentChar(statement[end]) {
+				end++
+			}
+			return strings.ToUpper(statement[i:end]), statement[end:]
+		}
+	}
+	return "", ""
+}
+
+// explainedStatement returns the statement explained by an EXPLAIN [ANALYZE] [VERBOSE] statement,
+// and false if statement is not an EXPLAIN statement.
+func explainedStatement(statement string) (string, bool) {
+	keyword, rest := nextKeyword(statement)
+	if keyword != StatementExplain {
+		return "", false
+	}
+	for _, option := range []string{"ANALYZE", "VERBOSE"} {
+		if keyword, next := nextKeyword(rest); keyword == option {
+			rest = next
+		}
+	}
+	return rest, true
+}
+
+// CheckStatements returns an error if any statement of sql is not in the allowed statement types.
+// The statement explained by an EXPLAIN statement must be allowed too, as EXPLAIN ANALYZE runs it.
+func CheckStatements(sql string, allowed []string) error {
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedStatements
+	}
+	for _, statement := range SplitStatements(sql) {
+		if err := checkStatement(statement, allowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkStatement(statement string, allowed []string) error {
+	statementType := ClassifyStatement(statement)
+	isAllowed := false
+	for _, a := range allowed {
+		if strings.EqualFold(strings.TrimSpace(a), statementType) {
+			isAllowed = true
+			break
+		}
+	}
+	if !isAllowed {
+		return fmt.Errorf("statement %q is not allowed, allowed statements are: %s", statementType, strings.Join(allowed, ", "))
+	}
+	if explained, ok := explainedStatement(statement); ok {
+		return checkStatement(explained, allowed)
+	}
+	return nil
+}
+
+// isReadOnlyStatement returns true if every statement of sql is one of DefaultAllowedStatements.
+func isReadOnlyStatement(sql string) bool {
+	return CheckStatements(sql, DefaultAllowedStatements) == nil
+}
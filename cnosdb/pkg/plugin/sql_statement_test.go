@@ -0,0 +1,102 @@
+package plugin_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cnosdb/cnos-cnosdb-datasource-backend/pkg/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected []string
+	}{
+		{
+			name:     "single statement",
+			sql:      "SELECT * FROM t",
+			expected: []string{"SELECT * FROM t"},
+		},
+		{
+			name:     "trailing separator",
+			sql:      "SELECT * FROM a; SELECT * FROM b;\n",
+			expected: []string{"SELECT * FROM a", "SELECT * FROM b"},
+		},
+		{
+			name:     "separators in strings and comments",
+			sql:      "SELECT ';' AS \"a;b\" FROM t -- x;y\n; /* ; */ SHOW TABLES",
+			expected: []string{"SELECT ';' AS \"a;b\" FROM t -- x;y", "/* ; */ SHOW TABLES"},
+		},
+		{
+			name:     "escaped quote",
+			sql:      "SELECT 'it''s; fine'; SHOW TABLES",
+			expected: []string{"SELECT 'it''s; fine'", "SHOW TABLES"},
+		},
+		{
+			name:     "only comments",
+			sql:      "-- nothing;\n",
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, plugin.SplitStatements(tt.sql))
+		})
+	}
+}
+
+func TestClassifyStatement(t *testing.T) {
+	tests := map[string]string{
+		"select * from t":                      "SELECT",
+		"  (SELECT 1) UNION (SELECT 2)":        "SELECT",
+		"WITH a AS (SELECT 1) SELECT * FROM a": "SELECT",
+		"WITH RECURSIVE a (x) AS (SELECT ')' FROM t), \"b\" AS MATERIALIZED (SELECT 2) (SELECT * FROM a)": "SELECT",
+		"with a as (select 1) insert into t select * from a":                                              "INSERT",
+		"WITH a AS NOT MATERIALIZED (SELECT 1) /* ; */ DELETE FROM t":                                     "DELETE",
+		"WITH a AS (SELECT 1)":      "WITH",
+		"WITH a SELECT 1":           "WITH",
+		"-- TAG;\nDESCRIBE TABLE t": "DESCRIBE",
+		"/* hint */ desc table t":   "DESCRIBE",
+		"drop table t":              "DROP",
+		"":                          "",
+	}
+	for sql, expected := range tests {
+		assert.Equal(t, expected, plugin.ClassifyStatement(sql), sql)
+	}
+}
+
+func TestCheckStatements(t *testing.T) {
+	assert.NoError(t, plugin.CheckStatements("SELECT 1; SHOW TABLES; EXPLAIN SELECT 1", nil))
+	assert.EqualError(t, plugin.CheckStatements("SELECT 1; DROP TABLE t", nil),
+		`statement "DROP" is not allowed, allowed statements are: SELECT, SHOW, DESCRIBE, EXPLAIN`)
+	assert.EqualError(t, plugin.CheckStatements("DELETE FROM t", nil),
+		`statement "DELETE" is not allowed, allowed statements are: SELECT, SHOW, DESCRIBE, EXPLAIN`)
+	assert.NoError(t, plugin.CheckStatements("insert into t values (1)", []string{"SELECT", "INSERT"}))
+	assert.EqualError(t, plugin.CheckStatements("WITH a AS (SELECT 1) INSERT INTO t SELECT * FROM a", nil),
+		`statement "INSERT" is not allowed, allowed statements are: SELECT, SHOW, DESCRIBE, EXPLAIN`)
+}
+
+func TestCheckExplainedStatements(t *testing.T) {
+	assert.NoError(t, plugin.CheckStatements("EXPLAIN ANALYZE VERBOSE SELECT * FROM t", nil))
+	assert.NoError(t, plugin.CheckStatements("explain verbose (select 1)", nil))
+
+	const notAllowed = `statement %q is not allowed, allowed statements are: SELECT, SHOW, DESCRIBE, EXPLAIN`
+	tests := map[string]string{
+		"EXPLAIN ANALYZE INSERT INTO t VALUES (1)":                "INSERT",
+		"explain analyze delete from t":                           "DELETE",
+		"EXPLAIN ANALYZE VERBOSE COPY INTO t FROM 's3://b/'":      "COPY",
+		"EXPLAIN /* x */ ANALYZE -- y\n DROP TABLE t":             "DROP",
+		"EXPLAIN EXPLAIN ANALYZE INSERT INTO t VALUES (1)":        "INSERT",
+		"SELECT 1; EXPLAIN ANALYZE INSERT INTO t SELECT * FROM t": "INSERT",
+	}
+	for sql, statementType := range tests {
+		assert.EqualError(t, plugin.CheckStatements(sql, nil), fmt.Sprintf(notAllowed, statementType), sql)
+	}
+
+	// The explained statement must be allowed too
+	assert.EqualError(t, plugin.CheckStatements("EXPLAIN SHOW TABLES", []string{"EXPLAIN", "SELECT"}),
+		`statement "SHOW" is not allowed, allowed statements are: EXPLAIN, SELECT`)
+}
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+)
+
+// applyTLSOptions sets the TLS options of the HTTP client. The SDK only reads the secure CA bundle,
+// client certificate and server name if tlsAuth or tlsAuthWithCACert is set, so they are applied
+// here for every mode. A CA stored in CaCert by older versions is used if the secure CA is missing.
+func applyTLSOptions(httpOptions *httpclient.Options, options *CnosdbDataSourceOptions, secureJsonData map[string]string) {
+	tlsOptions := httpOptions.TLS
+	if tlsOptions == nil {
+		tlsOptions = &httpclient.TLSOptions{}
+	}
+
+	if options.TLSAuthWithCACert {
+		tlsOptions.CACertificate = secureJsonData["tlsCACert"]
+		if tlsOptions.CACertificate == "" {
+			tlsOptions.CACertificate = options.CaCert
+		}
+	} else {
+		tlsOptions.CACertificate = ""
+	}
+	if options.TLSAuth {
+		tlsOptions.ClientCertificate = secureJsonData["tlsClientCert"]
+		tlsOptions.ClientKey = secureJsonData["tlsClientKey"]
+	} else {
+		tlsOptions.ClientCertificate = ""
+		tlsOptions.ClientKey = ""
+	}
+	tlsOptions.ServerName = options.ServerName
+	tlsOptions.InsecureSkipVerify = options.TLSSkipVerify
+
+	if *tlsOptions == (httpclient.TLSOptions{}) {
+		httpOptions.TLS = nil
+	} else {
+		httpOptions.TLS = tlsOptions
+	}
+}
+
+// isTLSVerificationError returns true if err is caused by the verification of the server certificate.
+func isTLSVerificationError(err error) bool {
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var systemRootsErr x509.SystemRootsError
+	return errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &certificateInvalidErr) ||
+		errors.As(err, &systemRootsErr)
+}
+
+// isTLSError returns true if the TLS handshake failed, e.g. the server certificate is not trusted
+// or the server doesn't speak TLS.
+func isTLSError(err error) bool {
+	var recordHeaderErr tls.RecordHeaderError
+	return isTLSVerificationError(err) || errors.As(err, &recordHeaderErr) || isTLSAlert(err)
+}
+
+// isTLSAlert returns true if the server sent a TLS alert, e.g. a missing client certificate.
+func isTLSAlert(err error) bool {
+	return strings.Contains(err.Error(), "remote error: tls:")
+}
+
+// tlsErrorHint describes how to fix a TLS error.
+func tlsErrorHint(err error) string {
+	var hostnameErr x509.HostnameError
+	var recordHeaderErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &hostnameErr):
+		return "the server certificate doesn't match the host, set the server name or fix the URL"
+	case isTLSVerificationError(err):
+		return "the server certificate is not trusted, add its CA certificate or skip TLS verification"
+	case isTLSAlert(err):
+		return "the server rejected the TLS handshake, check the client certificate and key"
+	case errors.As(err, &recordHeaderErr):
+		return "the server doesn't speak TLS, use an http URL"
+	default:
+		return ""
+	}
+}
+
+// tlsStatusError returns a downstream error of a failed TLS handshake, which is not retried.
+func tlsStatusError(err error) *StatusError {
+	statusErr := NewDownstreamError(backend.StatusBadGateway, fmt.Sprintf("TLS handshake failed: %s", err))
+	statusErr.Hint = tlsErrorHint(err)
+	return statusErr
+}
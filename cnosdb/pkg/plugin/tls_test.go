@@ -0,0 +1,84 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cnosdb/cnos-cnosdb-datasource-backend/pkg/plugin"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckHealthTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(cnosdbHandler))
+	defer server.Close()
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	// The certificate of the test server is valid for 127.0.0.1 and example.com
+	localhostUrl := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	cases := []struct {
+		name     string
+		options  map[string]interface{}
+		secure   map[string]string
+		status   backend.HealthStatus
+		contains string
+	}{
+		{
+			name:     "unknown authority",
+			options:  map[string]interface{}{"url": server.URL},
+			status:   backend.HealthStatusError,
+			contains: "TLS verification failed",
+		},
+		{
+			name:    "custom CA",
+			options: map[string]interface{}{"url": server.URL, "tlsAuthWithCACert": true},
+			secure:  map[string]string{"tlsCACert": caCert},
+			status:  backend.HealthStatusOk,
+		},
+		{
+			name:    "legacy CA",
+			options: map[string]interface{}{"url": server.URL, "tlsAuthWithCACert": true, "caCert": caCert},
+			status:  backend.HealthStatusOk,
+		},
+		{
+			name:     "host mismatch",
+			options:  map[string]interface{}{"url": localhostUrl, "tlsAuthWithCACert": true},
+			secure:   map[string]string{"tlsCACert": caCert},
+			status:   backend.HealthStatusError,
+			contains: "set the server name",
+		},
+		{
+			name:    "server name",
+			options: map[string]interface{}{"url": localhostUrl, "tlsAuthWithCACert": true, "serverName": "example.com"},
+			secure:  map[string]string{"tlsCACert": caCert},
+			status:  backend.HealthStatusOk,
+		},
+		{
+			name:    "skip verify",
+			options: map[string]interface{}{"url": server.URL, "tlsSkipVerify": true},
+			status:  backend.HealthStatusOk,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			jsonData, _ := json.Marshal(c.options)
+			instance, err := plugin.NewCnosdbDatasource(backend.DataSourceInstanceSettings{
+				JSONData:                jsonData,
+				DecryptedSecureJSONData: c.secure,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := instance.(*plugin.CnosdbDatasource).CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+			assert.NoError(t, err)
+			assert.Equal(t, c.status, res.Status, res.Message)
+			assert.Contains(t, res.Message, c.contains)
+		})
+	}
+}
@@ -43,20 +43,70 @@ func ParseIntervalString(intervalStr string) time.Duration {
 		return 0
 	}
 
-	// TODO: support century decade year month week day (hour minute second) millisecond microsecond nanosecond
+	// TODO: support century decade year month microsecond nanosecond
 	// TODO: support combined interval string (3 year 1 month; 3 year -1 month)
 	unit := strings.ToLower(seg[1])
-	if strings.HasPrefix(unit, "second") {
+	if strings.HasPrefix(unit, "millisecond") {
+		return time.Duration(num) * time.Millisecond
+	} else if strings.HasPrefix(unit, "second") {
 		return time.Duration(num) * time.Second
 	} else if strings.HasPrefix(unit, "minute") {
 		return time.Duration(num) * time.Minute
 	} else if strings.HasPrefix(unit, "hour") {
 		return time.Duration(num) * time.Hour
+	} else if strings.HasPrefix(unit, "day") {
+		return time.Duration(num) * 24 * time.Hour
+	} else if strings.HasPrefix(unit, "week") {
+		return time.Duration(num) * 7 * 24 * time.Hour
 	} else {
 		return 0
 	}
 }
 
+// intervalSteps are the human-friendly intervals an automatic interval is rounded up to.
+var intervalSteps = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	15 * time.Second,
+	20 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	2 * time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	15 * time.Minute,
+	20 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+	3 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// RoundInterval rounds an interval up to the next human-friendly step,
+// intervals longer than a week are rounded up to whole weeks.
+func RoundInterval(interval time.Duration) time.Duration {
+	for _, step := range intervalSteps {
+		if interval <= step {
+			return step
+		}
+	}
+	week := intervalSteps[len(intervalSteps)-1]
+	return (interval + week - 1) / week * week
+}
+
 func typeof(value interface{}) string {
 	if value != nil {
 		return fmt.Sprintf("%T", value)
@@ -68,3 +118,32 @@ func CompileVariableRegexp(variableName string) *regexp.Regexp {
 	str := fmt.Sprintf("\\$\\{?%s\\}?", variableName)
 	return regexp.MustCompile(str)
 }
+
+// LevenshteinDistance returns the number of single character edits to change a into b.
+func LevenshteinDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -48,3 +48,18 @@ func TestParseIntervalString(t *testing.T) {
 	interval = ParseIntervalString("10 hours")
 	assert.Equal(t, interval, time.Duration(10)*time.Hour)
 }
+
+func TestRoundInterval(t *testing.T) {
+	assert.Equal(t, time.Millisecond, RoundInterval(time.Microsecond))
+	assert.Equal(t, 15*time.Second, RoundInterval(11*time.Second))
+	assert.Equal(t, time.Minute, RoundInterval(time.Minute))
+	assert.Equal(t, 15*time.Minute, RoundInterval(604800*time.Millisecond))
+	assert.Equal(t, 14*24*time.Hour, RoundInterval(8*24*time.Hour))
+}
+
+func TestLevenshteinDistance(t *testing.T) {
+	assert.Equal(t, 0, LevenshteinDistance("cpu", "cpu"))
+	assert.Equal(t, 1, LevenshteinDistance("cpu_usag", "cpu_usage"))
+	assert.Equal(t, 3, LevenshteinDistance("", "cpu"))
+	assert.Equal(t, 4, LevenshteinDistance("mem", "cpu_mem"))
+}
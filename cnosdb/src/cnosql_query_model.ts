@@ -3,9 +3,9 @@ import { filter, find, indexOf, map } from 'lodash';
 import { ScopedVars } from '@grafana/data';
 import { TemplateSrv } from '@grafana/runtime';
 
-import { CnosQuery, SelectItem, TagItem } from './types';
+import { CnosQuery, NestedQuery, SelectItem, TagItem } from './types';
 import { QueryPart } from './query_part';
-import { regexEscape } from './utils';
+import { formatHaving, formatOrderBy, regexEscape } from './utils';
 import queryPart from './cnosql_query_part';
 
 export default class CnosQueryModel {
@@ -193,6 +193,22 @@ export default class CnosQueryModel {
     return table;
   }
 
+  renderNested(query: NestedQuery, interpolate: any) {
+    const model = new CnosQueryModel({ refId: this.target.refId, ...query } as CnosQuery, this.templateSrv, this.scopedVars);
+    return '(' + model.render(interpolate) + ')';
+  }
+
+  renderSource(interpolate: any) {
+    const target = this.target;
+    let source = target.subquery ? this.renderNested(target.subquery, interpolate) : this.getTable(interpolate);
+    if (target.join) {
+      const using = map(target.join.using, (column) => (column === 'time' ? column : '"' + column + '"'));
+      source += '\n' + (target.join.type ?? 'INNER') + ' JOIN ' + this.renderNested(target.join.query, interpolate);
+      source += ' USING (' + using.join(', ') + ')';
+    }
+    return source;
+  }
+
   interpolateQueryStr(value: any[], variable: { multi: any; includeAll: any }, defaultFormatFn: any) {
     // if no multi or include all do not regexEscape
     if (!variable.multi && !variable.includeAll) {
@@ -240,7 +256,7 @@ export default class CnosQueryModel {
       query += selectText;
     }
 
-    query += '\nFROM ' + this.getTable(interpolate) + '\nWHERE ';
+    query += '\nFROM ' + this.renderSource(interpolate) + '\nWHERE ';
     const conditions = map(target.tags, (tag, index) => {
       return this.renderTagCondition(tag, index, interpolate);
     });
@@ -267,15 +283,27 @@ export default class CnosQueryModel {
       query += '\nGROUP BY ' + groupBySection;
     }
 
-    if (target.orderByTime === 'DESC') {
-      query += '\nORDER BY time DESC';
+    const having = formatHaving(target.having);
+    if (having !== undefined) {
+      query += '\nHAVING ' + having;
+    }
+
+    const orderBy = formatOrderBy(target.orderBy);
+    const orderByTime = target.orderByTime === 'DESC' ? 'time DESC' : 'time ASC';
+    if (orderBy === undefined) {
+      query += '\nORDER BY ' + orderByTime;
+    } else if (target.orderBy?.some((item) => item.column === 'time')) {
+      query += '\nORDER BY ' + orderBy;
     } else {
-      query += '\nORDER BY time ASC';
+      query += '\nORDER BY ' + orderBy + ', ' + orderByTime;
     }
 
-    if (target.limit) {
+    if (target.limit && target.limit !== 'none') {
       query += '\nLIMIT ' + target.limit;
     }
+    if (target.offset) {
+      query += '\nOFFSET ' + target.offset;
+    }
 
     return query;
   }
@@ -1,6 +1,6 @@
 import { clone, map } from 'lodash';
 
-import { functionRenderer, QueryPart, QueryPartDef } from './query_part';
+import { functionRenderer, QueryPart, QueryPartDef, suffixRenderer } from './query_part';
 
 const index: any[] = [];
 const categories: any = {
@@ -88,6 +88,40 @@ function replaceAggregationAddStrategy(selectParts: any[], partModel: { def: { t
   selectParts.splice(1, 0, partModel);
 }
 
+function addTransformationStrategy(selectParts: any[], partModel: any) {
+  let i;
+  // look for index to add transformation
+  for (i = 0; i < selectParts.length; i++) {
+    const part = selectParts[i];
+    if (part.def.category === categories.Math || part.def.category === categories.Aliasing) {
+      break;
+    }
+  }
+
+  selectParts.splice(i, 0, partModel);
+}
+
+function addMathStrategy(selectParts: any[], partModel: any) {
+  const partCount = selectParts.length;
+  if (partCount > 0) {
+    // if last is math, replace it
+    if (selectParts[partCount - 1].def.type === 'math') {
+      selectParts[partCount - 1] = partModel;
+      return;
+    }
+    // if next to last is math, replace it
+    if (partCount > 1 && selectParts[partCount - 2].def.type === 'math') {
+      selectParts[partCount - 2] = partModel;
+      return;
+    } else if (selectParts[partCount - 1].def.type === 'alias') {
+      // if last is alias add it before
+      selectParts.splice(partCount - 1, 0, partModel);
+      return;
+    }
+  }
+  selectParts.push(partModel);
+}
+
 function addAliasStrategy(selectParts: any[], partModel: any) {
   const partCount = selectParts.length;
   if (partCount > 0) {
@@ -182,6 +216,153 @@ register({
   renderer: functionRenderer,
 });
 
+register({
+  type: 'distinct',
+  addStrategy: replaceAggregationAddStrategy,
+  category: categories.Aggregations,
+  params: [],
+  defaultParams: [],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'median',
+  addStrategy: replaceAggregationAddStrategy,
+  category: categories.Aggregations,
+  params: [],
+  defaultParams: [],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'mode',
+  addStrategy: replaceAggregationAddStrategy,
+  category: categories.Aggregations,
+  params: [],
+  defaultParams: [],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'spread',
+  addStrategy: replaceAggregationAddStrategy,
+  category: categories.Aggregations,
+  params: [],
+  defaultParams: [],
+  renderer: functionRenderer,
+});
+
+// Selectors
+register({
+  type: 'first',
+  addStrategy: replaceAggregationAddStrategy,
+  category: categories.Selectors,
+  params: [],
+  defaultParams: [],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'last',
+  addStrategy: replaceAggregationAddStrategy,
+  category: categories.Selectors,
+  params: [],
+  defaultParams: [],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'percentile_cont',
+  addStrategy: replaceAggregationAddStrategy,
+  category: categories.Selectors,
+  params: [{ name: 'percentile', type: 'number' }],
+  defaultParams: [0.95],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'approx_percentile',
+  addStrategy: replaceAggregationAddStrategy,
+  category: categories.Selectors,
+  params: [{ name: 'percentile', type: 'number' }],
+  defaultParams: [0.95],
+  renderer: functionRenderer,
+});
+
+// Transformations
+register({
+  type: 'derivative',
+  addStrategy: addTransformationStrategy,
+  category: categories.Transformations,
+  params: [{ name: 'unit', type: 'interval', options: ['1s', '1m', '1h'], optional: true }],
+  defaultParams: ['1s'],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'non_negative_derivative',
+  addStrategy: addTransformationStrategy,
+  category: categories.Transformations,
+  params: [{ name: 'unit', type: 'interval', options: ['1s', '1m', '1h'], optional: true }],
+  defaultParams: ['1s'],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'difference',
+  addStrategy: addTransformationStrategy,
+  category: categories.Transformations,
+  params: [],
+  defaultParams: [],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'moving_average',
+  addStrategy: addTransformationStrategy,
+  category: categories.Transformations,
+  params: [{ name: 'window', type: 'int', options: [5, 10, 20, 30, 40] }],
+  defaultParams: [10],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'cumulative_sum',
+  addStrategy: addTransformationStrategy,
+  category: categories.Transformations,
+  params: [],
+  defaultParams: [],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'rate',
+  addStrategy: addTransformationStrategy,
+  category: categories.Transformations,
+  params: [],
+  defaultParams: [],
+  renderer: functionRenderer,
+});
+
+register({
+  type: 'increase',
+  addStrategy: addTransformationStrategy,
+  category: categories.Transformations,
+  params: [],
+  defaultParams: [],
+  renderer: functionRenderer,
+});
+
+// Math
+register({
+  type: 'math',
+  addStrategy: addMathStrategy,
+  category: categories.Math,
+  params: [{ name: 'expr', type: 'string' }],
+  defaultParams: [' / 100'],
+  renderer: suffixRenderer,
+});
+
 // transformations
 //
 register({
@@ -192,7 +373,7 @@ register({
       name: 'interval',
       type: 'time',
       // TODO: Use simplified time '1s', '10s', '1m'...
-      options: ['1 second', '10 seconds', '1 minute', '5 minutes', '10 minutes', '15 minutes', '1 hour'],
+      options: ['auto', '1 second', '10 seconds', '1 minute', '5 minutes', '10 minutes', '15 minutes', '1 hour'],
     },
   ],
   defaultParams: ['1 minute'],
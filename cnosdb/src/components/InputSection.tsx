@@ -1,7 +1,7 @@
 import { css, cx } from '@emotion/css';
-import React from 'react';
+import React, { useState } from 'react';
 
-import { Input } from '@grafana/ui';
+import { FieldValidationMessage, Input } from '@grafana/ui';
 
 import { useShadowedState } from './use_shadowed_state';
 
@@ -10,15 +10,22 @@ type Props = {
   onChange: (value: string | undefined) => void;
   isWide?: boolean;
   placeholder?: string;
+  // returns the error of an invalid value, which is kept in the input instead of being changed
+  validate?: (value: string | undefined) => string | undefined;
 };
 
-export const InputSection = ({ value, onChange, isWide, placeholder }: Props): JSX.Element => {
+export const InputSection = ({ value, onChange, isWide, placeholder, validate }: Props): JSX.Element => {
   const [currentValue, setCurrentValue] = useShadowedState(value);
+  const [error, setError] = useState<string | undefined>(undefined);
 
   const onBlur = () => {
     // Send empty-string as undefined
     const newValue = currentValue === '' ? undefined : currentValue;
-    onChange(newValue);
+    const newError = validate?.(newValue);
+    setError(newError);
+    if (newError === undefined) {
+      onChange(newValue);
+    }
   };
 
   return (
@@ -33,12 +40,14 @@ export const InputSection = ({ value, onChange, isWide, placeholder }: Props): J
         )}
         type="text"
         spellCheck={false}
+        invalid={error !== undefined}
         onBlur={onBlur}
         onChange={(e) => {
           setCurrentValue(e.currentTarget.value);
         }}
         value={currentValue ?? ''}
       />
+      {error !== undefined && <FieldValidationMessage horizontal={true}>{error}</FieldValidationMessage>}
     </>
   );
 };
@@ -7,6 +7,7 @@ import { CnosDataSource } from '../datasource';
 import { CnosDataSourceOptions, CnosQuery } from '../types';
 import { buildRawQuery } from '../query_utils';
 import { RawQueryEditor } from './RawQueryEditor';
+import { TargetSection } from './TargetSection';
 import { QueryEditorModeSwitcher } from './QueryEditorModeSwitcher';
 import { VisualQueryEditor } from './VisualQueryEditor';
 
@@ -21,6 +22,7 @@ export const QueryEditor = ({ query, onChange, onRunQuery, datasource }: Props):
         ) : (
           <VisualQueryEditor query={query} onChange={onChange} onRunQuery={onRunQuery} datasource={datasource} />
         )}
+        <TargetSection query={query} datasource={datasource} onChange={onChange} onRunQuery={onRunQuery} />
       </div>
       <QueryEditorModeSwitcher
         isRaw={query.rawQuery ?? false}
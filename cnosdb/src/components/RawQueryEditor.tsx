@@ -1,6 +1,6 @@
 import React from 'react';
 
-import { CodeEditor, HorizontalGroup, InlineFormLabel, Input } from '@grafana/ui';
+import { CodeEditor, HorizontalGroup, InlineFormLabel, InlineSwitch, Input } from '@grafana/ui';
 
 import { CnosQuery } from '../types';
 import { useShadowedState } from './use_shadowed_state';
@@ -15,6 +15,7 @@ type Props = {
 export const RawQueryEditor = ({ query, onChange, onRunQuery }: Props): JSX.Element => {
   const [currentAlias, setCurrentAlias] = useShadowedState(query.alias);
   const aliasElementId = useUniqueId();
+  const concurrentElementId = useUniqueId();
 
   const onRawQueryChange = (newQuery: string) => {
     onChange({
@@ -32,6 +33,14 @@ export const RawQueryEditor = ({ query, onChange, onRunQuery }: Props): JSX.Elem
     onRunQuery();
   };
 
+  const onConcurrentStatementsChange = (concurrentStatements: boolean) => {
+    onChange({
+      ...query,
+      concurrentStatements,
+    });
+    onRunQuery();
+  };
+
   return (
     <div>
       <CodeEditor
@@ -57,6 +66,18 @@ export const RawQueryEditor = ({ query, onChange, onRunQuery }: Props): JSX.Elem
           }}
           value={currentAlias ?? ''}
         />
+        <InlineFormLabel
+          htmlFor={concurrentElementId}
+          width={12}
+          tooltip="Run the statements separated by ';' concurrently instead of one after another"
+        >
+          Concurrent statements
+        </InlineFormLabel>
+        <InlineSwitch
+          id={concurrentElementId}
+          value={query.concurrentStatements ?? false}
+          onChange={(e) => onConcurrentStatementsChange(e.currentTarget.checked)}
+        />
       </HorizontalGroup>
     </div>
   );
@@ -0,0 +1,80 @@
+import React from 'react';
+
+import { SelectableValue } from '@grafana/data';
+import { HorizontalGroup, InlineFormLabel, Input, Select } from '@grafana/ui';
+
+import { CnosDataSource } from '../datasource';
+import { CnosQuery } from '../types';
+import { useShadowedState } from './use_shadowed_state';
+import { useUniqueId } from './use_unique_id';
+
+type Props = {
+  query: CnosQuery;
+  datasource: CnosDataSource;
+  onChange: (query: CnosQuery) => void;
+  onRunQuery: () => void;
+};
+
+function toOptions(values: string[]): Array<SelectableValue<string>> {
+  return values.map((v) => ({ label: v, value: v }));
+}
+
+// TargetSection overrides the database, tenant and timeout of the datasource for a query, only the
+// databases and tenants allowed by the datasource can be chosen.
+export const TargetSection = ({ query, datasource, onChange, onRunQuery }: Props): JSX.Element => {
+  const { allowedDatabases, allowedTenants } = datasource;
+  const [currentTimeout, setCurrentTimeout] = useShadowedState(query.timeout);
+  const timeoutElementId = useUniqueId();
+
+  const onTargetChange = (key: 'database' | 'tenant' | 'timeout', value: string | undefined) => {
+    onChange({ ...query, [key]: value });
+    onRunQuery();
+  };
+
+  return (
+    <HorizontalGroup>
+      {allowedDatabases.length > 0 && (
+        <>
+          <InlineFormLabel width={8} tooltip="Run this query on another database than the datasource's">
+            Database
+          </InlineFormLabel>
+          <Select
+            width={20}
+            isClearable={true}
+            placeholder="default"
+            options={toOptions(allowedDatabases)}
+            value={query.database ?? null}
+            onChange={(v) => onTargetChange('database', v?.value)}
+          />
+        </>
+      )}
+      {allowedTenants.length > 0 && (
+        <>
+          <InlineFormLabel width={8} tooltip="Run this query on another tenant than the datasource's">
+            Tenant
+          </InlineFormLabel>
+          <Select
+            width={20}
+            isClearable={true}
+            placeholder="default"
+            options={toOptions(allowedTenants)}
+            value={query.tenant ?? null}
+            onChange={(v) => onTargetChange('tenant', v?.value)}
+          />
+        </>
+      )}
+      <InlineFormLabel htmlFor={timeoutElementId} width={8} tooltip="Override the query timeout of the datasource">
+        Timeout
+      </InlineFormLabel>
+      <Input
+        id={timeoutElementId}
+        type="text"
+        width={20}
+        placeholder="default"
+        value={currentTimeout ?? ''}
+        onChange={(e) => setCurrentTimeout(e.currentTarget.value)}
+        onBlur={() => onTargetChange('timeout', currentTimeout || undefined)}
+      />
+    </HorizontalGroup>
+  );
+};
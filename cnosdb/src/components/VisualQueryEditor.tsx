@@ -15,6 +15,7 @@ import {
   removeGroupByPart,
   removeSelectPart,
 } from '../query_utils';
+import { formatHaving, formatOrderBy, parseError, parseHaving, parseOrderBy } from '../utils';
 import { getAllTables, getFieldNamesFromTable, getTagKeysFromTable, getTagValuesFromTable } from '../meta_query';
 import { getNewGroupByPartOptions, getNewSelectPartOptions, makePartList } from './part_list_utils';
 import { FromSection } from './FromSection';
@@ -41,28 +42,30 @@ export const VisualQueryEditor = (props: Props): JSX.Element => {
   const query = normalizeQuery(props.query);
   const { datasource } = props;
   const { table } = query;
+  const target = useMemo(() => ({ database: query.database, tenant: query.tenant }), [query.database, query.tenant]);
 
   const allTagKeys = useMemo(() => {
-    return getTagKeysFromTable(table, [], datasource).then((tags) => {
+    return getTagKeysFromTable(table, [], datasource, target).then((tags) => {
       return new Set(tags);
     });
-  }, [table, datasource]);
+  }, [table, datasource, target]);
 
   const selectLists = useMemo(() => {
     const selectPartOptions = new Map([
       [
         'field_0',
         () => {
-          return table !== undefined ? getFieldNamesFromTable(table, datasource) : Promise.resolve([]);
+          return table !== undefined ? getFieldNamesFromTable(table, datasource, target) : Promise.resolve([]);
         },
       ],
     ]);
     return (query.select ?? []).map((sel) => makePartList(sel, selectPartOptions));
-  }, [table, query.select, datasource]);
+  }, [table, query.select, datasource, target]);
 
   const getTagKeys = useMemo(() => {
-    return () => allTagKeys.then((keys) => getTagKeysFromTable(table, filterTags(query.tags ?? [], keys), datasource));
-  }, [table, query.tags, datasource, allTagKeys]);
+    return () =>
+      allTagKeys.then((keys) => getTagKeysFromTable(table, filterTags(query.tags ?? [], keys), datasource, target));
+  }, [table, query.tags, datasource, allTagKeys, target]);
 
   function filterTags(parts: TagItem[], allTagKeys: Set<string>): TagItem[] {
     return parts.filter((t) => allTagKeys.has(t.key));
@@ -105,7 +108,7 @@ export const VisualQueryEditor = (props: Props): JSX.Element => {
         <FromSection
           table={table}
           onChange={handleFromSectionChange}
-          getTableOptions={(filter) => getAllTables(filter === '' ? undefined : filter, datasource)}
+          getTableOptions={(filter) => getAllTables(filter === '' ? undefined : filter, datasource, target)}
         />
         <InlineLabel width="auto" className={styles.inlineLabel}>
           WHERE
@@ -116,7 +119,7 @@ export const VisualQueryEditor = (props: Props): JSX.Element => {
           getTagKeyOptions={getTagKeys}
           getTagValueOptions={(key: string) => {
             return allTagKeys.then((keys) => {
-              return getTagValuesFromTable(table, key, filterTags(query.tags ?? [], keys), datasource);
+              return getTagValuesFromTable(table, key, filterTags(query.tags ?? [], keys), datasource, target);
             });
           }}
         />
@@ -154,17 +157,79 @@ export const VisualQueryEditor = (props: Props): JSX.Element => {
             onAppliedChange(removeGroupByPart(query, partIndex));
           }}
         />
+        <InlineLabel
+          width="auto"
+          className={styles.inlineLabel}
+          tooltip="Conditions on the groups, e.g. avg > 80 AND peak < 100. Columns are the aliases or function names of the aggregates, suffixed with the field if several aggregates share a name, e.g. avg_usage"
+        >
+          HAVING
+        </InlineLabel>
+        <InputSection
+          isWide={true}
+          placeholder="(optional)"
+          value={formatHaving(query.having)}
+          validate={(having) => parseError(() => parseHaving(having))}
+          onChange={(having) => {
+            onAppliedChange({ ...query, having: parseHaving(having) });
+          }}
+        />
       </SegmentSection>
       <SegmentSection label="LIMIT" fill={true}>
         <InputSection
-          placeholder="(optional)"
+          placeholder="(default) or none"
           value={query.limit?.toString()}
           onChange={(limit) => {
             onAppliedChange({ ...query, limit });
           }}
         />
         <InlineLabel width="auto" className={styles.inlineLabel}>
-          ORDER BY TIME
+          OFFSET
+        </InlineLabel>
+        <InputSection
+          placeholder="(optional)"
+          value={query.offset}
+          onChange={(offset) => {
+            onAppliedChange({ ...query, offset });
+          }}
+        />
+        <InlineLabel width="auto" className={styles.inlineLabel} tooltip="Maximum number of series grouped by tags">
+          SLIMIT
+        </InlineLabel>
+        <InputSection
+          placeholder="(optional)"
+          value={query.slimit}
+          onChange={(slimit) => {
+            onAppliedChange({ ...query, slimit });
+          }}
+        />
+        <InlineLabel width="auto" className={styles.inlineLabel} tooltip="Maximum number of rows of each series">
+          PER SERIES
+        </InlineLabel>
+        <InputSection
+          placeholder="(optional)"
+          value={query.seriesLimit}
+          onChange={(seriesLimit) => {
+            onAppliedChange({ ...query, seriesLimit });
+          }}
+        />
+        <InlineLabel
+          width="auto"
+          className={styles.inlineLabel}
+          tooltip="Sort keys before the time, e.g. avg DESC NULLS LAST, host. Columns are the time, GROUP BY tags and the aliases or function names of the selectors, function names shared by several selectors are suffixed with the field, e.g. avg_usage"
+        >
+          ORDER BY
+        </InlineLabel>
+        <InputSection
+          isWide={true}
+          placeholder="(optional)"
+          value={formatOrderBy(query.orderBy)}
+          validate={(orderBy) => parseError(() => parseOrderBy(orderBy))}
+          onChange={(orderBy) => {
+            onAppliedChange({ ...query, orderBy: parseOrderBy(orderBy) });
+          }}
+        />
+        <InlineLabel width="auto" className={styles.inlineLabel}>
+          THEN BY TIME
         </InlineLabel>
         <OrderByTimeSection
           value={query.orderByTime === 'DESC' ? 'DESC' : 'ASC'}
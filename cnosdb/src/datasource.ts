@@ -11,7 +11,7 @@ import {
 } from '@grafana/data';
 import { BackendSrvRequest, DataSourceWithBackend, getBackendSrv, getTemplateSrv, TemplateSrv } from '@grafana/runtime';
 
-import { CnosDataSourceOptions, CnosQuery, SelectItem, TagItem } from './types';
+import { CnosDataSourceOptions, CnosQuery, QueryTarget, SelectItem, TagItem } from './types';
 import { cloneDeep, each, findIndex, zip } from 'lodash';
 import {
   customQuerySchema,
@@ -23,6 +23,8 @@ import {
 
 export class CnosDataSource extends DataSourceWithBackend<CnosQuery, CnosDataSourceOptions> {
   datasourceUid: string;
+  allowedDatabases: string[];
+  allowedTenants: string[];
 
   constructor(
     instanceSettings: DataSourceInstanceSettings<CnosDataSourceOptions>,
@@ -30,24 +32,26 @@ export class CnosDataSource extends DataSourceWithBackend<CnosQuery, CnosDataSou
   ) {
     super(instanceSettings);
     this.datasourceUid = instanceSettings.uid;
+    this.allowedDatabases = instanceSettings.jsonData.allowedDatabases ?? [];
+    this.allowedTenants = instanceSettings.jsonData.allowedTenants ?? [];
   }
 
   async metricFindQuery(query: string, options?: any): Promise<MetricFindValue[]> {
     const interpolated = this.templateSrv.replace(query, undefined, 'regex');
-    return lastValueFrom(this._fetchMetric(interpolated)).then((results) => {
+    return lastValueFrom(this._fetchMetric(interpolated, options?.target)).then((results) => {
       let ret = this._parseMetricFindResult(query, results);
       return ret;
     });
   }
 
-  _fetchMetric(query: string) {
+  _fetchMetric(query: string, target?: QueryTarget) {
     if (!query) {
       return of({ results: [] });
     }
-    return this._doRequest(query, 'MetricQuery');
+    return this._doRequest(query, 'MetricQuery', target);
   }
 
-  _doRequest(query: string, refId: string, options?: any) {
+  _doRequest(query: string, refId: string, target?: QueryTarget) {
     const req: BackendSrvRequest = {
       method: 'POST',
       url: '/api/ds/query',
@@ -58,6 +62,8 @@ export class CnosDataSource extends DataSourceWithBackend<CnosQuery, CnosDataSou
             datasource: { uid: this.datasourceUid },
             rawQuery: true,
             queryText: query,
+            database: target?.database,
+            tenant: target?.tenant,
           },
         ],
       },
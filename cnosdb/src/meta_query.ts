@@ -1,8 +1,12 @@
 import { CnosDataSource } from './datasource';
-import { TagItem } from './types';
+import { QueryTarget, TagItem } from './types';
 
-export async function getAllTables(filter: string | undefined, datasource: CnosDataSource): Promise<string[]> {
-  const data = await datasource.metricFindQuery('SHOW TABLES', datasource);
+export async function getAllTables(
+  filter: string | undefined,
+  datasource: CnosDataSource,
+  target?: QueryTarget
+): Promise<string[]> {
+  const data = await datasource.metricFindQuery('SHOW TABLES', { target });
   const filterRegexp = filter === undefined ? '.*' : '.*' + filter + '.*';
   return data.filter((item) => item.text.match(filterRegexp)).map((item) => item.text);
 }
@@ -10,9 +14,10 @@ export async function getAllTables(filter: string | undefined, datasource: CnosD
 export async function getTagKeysFromTable(
   table: string | undefined,
   tags: TagItem[],
-  datasource: CnosDataSource
+  datasource: CnosDataSource,
+  target?: QueryTarget
 ): Promise<string[]> {
-  const data = await datasource.metricFindQuery('-- TAG;\nDESCRIBE TABLE ' + table, datasource);
+  const data = await datasource.metricFindQuery('-- TAG;\nDESCRIBE TABLE ' + table, { target });
   return data.map((item) => item.text);
 }
 
@@ -20,13 +25,20 @@ export async function getTagValuesFromTable(
   table: string | undefined,
   tagKey: string,
   tags: TagItem[],
-  datasource: CnosDataSource
+  datasource: CnosDataSource,
+  target?: QueryTarget
 ): Promise<string[]> {
-  const data = await datasource.metricFindQuery('SHOW TAG VALUES FROM ' + table + ' WITH KEY=' + tagKey, datasource);
+  // The backend unquotes the key for CnosDB versions not supporting quoted tag keys
+  const quotedKey = '"' + tagKey.replace(/"/g, '""') + '"';
+  const data = await datasource.metricFindQuery('SHOW TAG VALUES FROM ' + table + ' WITH KEY = ' + quotedKey, { target });
   return data.map((item) => item.text);
 }
 
-export async function getFieldNamesFromTable(table: string | undefined, datasource: CnosDataSource): Promise<string[]> {
-  const data = await datasource.metricFindQuery('-- FIELD;\nDESCRIBE TABLE ' + table, datasource);
+export async function getFieldNamesFromTable(
+  table: string | undefined,
+  datasource: CnosDataSource,
+  target?: QueryTarget
+): Promise<string[]> {
+  const data = await datasource.metricFindQuery('-- FIELD;\nDESCRIBE TABLE ' + table, { target });
   return data.map((item) => item.text);
 }
@@ -4,25 +4,51 @@ import { DataQuery, DataSourceJsonData } from '@grafana/schema';
  * These are options configured for each DataSource instance
  */
 export interface CnosDataSourceOptions extends DataSourceJsonData {
+  url?: string;
+  /** @deprecated use url */
   host?: string;
+  /** @deprecated use url */
   port?: number;
   database?: string;
 
   cnosdbMode?: CnosdbMode;
   tenant?: string;
+  /** @deprecated the API key is stored in secure JSON data */
   apiKey?: string;
 
+  authType?: AuthType;
   basicAuth?: boolean;
   basicAuthUser?: string;
+  oauthPassThru?: boolean;
+  identityMappings?: IdentityMapping[];
+  allowedDatabases?: string[];
+  allowedTenants?: string[];
 
+  /** @deprecated use url */
   enableHttps?: boolean;
   tlsSkipVerify?: boolean;
   tlsAuthWithCACert?: boolean;
+  tlsAuth?: boolean;
+  serverName?: string;
+  /** @deprecated the CA certificate is stored in secure JSON data */
   caCert?: string;
 
   targetPartitions?: number;
   streamTriggerInterval?: string;
   useChunkedResponse?: boolean;
+  minInterval?: string;
+  allowedStatements?: string[];
+  retryAttempts?: number;
+  retryBackoff?: string;
+  retryTimeout?: string;
+  endpoints?: string[];
+  loadBalancing?: LoadBalancing;
+  endpointCooldown?: string;
+  queryTimeout?: string;
+  killQueryOnCancel?: boolean;
+  maxRows?: number;
+  maxBytes?: number;
+  defaultLimit?: number;
 }
 
 export enum CnosdbMode {
@@ -30,17 +56,47 @@ export enum CnosdbMode {
   PublicCloud = 1,
 }
 
+export interface IdentityMapping {
+  orgId?: number;
+  login?: string;
+  role?: string;
+  tenant?: string;
+  database?: string;
+  basicAuthUser?: string;
+  // overrides queries of the mapped users may choose instead of the allowed ones of the datasource
+  allowedDatabases?: string[];
+  allowedTenants?: string[];
+}
+
+export enum AuthType {
+  Basic = 'basic',
+  BearerToken = 'bearerToken',
+  OAuthPassThrough = 'oauthPassThrough',
+}
+
+export enum LoadBalancing {
+  RoundRobin = 'roundRobin',
+  LeastLatency = 'leastLatency',
+}
+
 /**
  * Value that is used in the backend, but never sent over HTTP to the frontend
  */
 export interface CnosSecureJsonData {
   basicAuthPassword?: string;
+  apiKey?: string;
+  bearerToken?: string;
 
   tlsCACert?: string;
+  tlsClientCert?: string;
+  tlsClientKey?: string;
 }
 
 export interface CnosQuery extends DataQuery {
   table?: string;
+  // selected from instead of table
+  subquery?: NestedQuery;
+  join?: JoinItem;
   select: SelectItem[][];
   tags?: TagItem[];
   rawTagsExpr?: string;
@@ -48,12 +104,49 @@ export interface CnosQuery extends DataQuery {
   interval?: string;
   fill?: string;
   orderByTime?: string;
+  having?: HavingItem[];
+  orderBy?: OrderByItem[];
   limit?: string | number;
+  offset?: string;
+  slimit?: string;
+  seriesLimit?: string;
   tz?: string;
+  database?: string;
+  tenant?: string;
+  timeout?: string;
 
   rawQuery?: boolean;
   queryText?: string;
   alias?: string;
+  concurrentStatements?: boolean;
+}
+
+// A subquery or joined query, its tags and named columns, e.g. avg_used for avg of used, are selected by the outer query
+export type NestedQuery = Omit<CnosQuery, keyof DataQuery>;
+
+export interface JoinItem {
+  type?: 'INNER' | 'LEFT' | 'RIGHT' | 'FULL';
+  query: NestedQuery;
+  // the time and tag columns to join on, must include time
+  using: string[];
+}
+
+export interface HavingItem {
+  column: string;
+  operator?: string;
+  value: string;
+  condition?: 'AND' | 'OR';
+}
+
+export interface OrderByItem {
+  column: string;
+  direction?: 'ASC' | 'DESC';
+  nulls?: 'FIRST' | 'LAST';
+}
+
+export interface QueryTarget {
+  database?: string;
+  tenant?: string;
 }
 
 export interface SelectItem {
@@ -0,0 +1,45 @@
+import { formatHaving, formatOrderBy, parseError, parseHaving, parseOrderBy } from './utils';
+
+describe('parseOrderBy', () => {
+  it('parses sort keys formatted by formatOrderBy', () => {
+    const orderBy = [
+      { column: 'avg', direction: 'DESC' as const, nulls: 'LAST' as const },
+      { column: 'host name' },
+      { column: 'peak "b"', direction: 'ASC' as const },
+    ];
+    expect(formatOrderBy(orderBy)).toBe('avg DESC NULLS LAST, "host name", "peak ""b""" ASC');
+    expect(parseOrderBy(formatOrderBy(orderBy))).toEqual(orderBy);
+    expect(parseOrderBy(' avg desc nulls first ')).toEqual([{ column: 'avg', direction: 'DESC', nulls: 'FIRST' }]);
+    expect(parseOrderBy('  ')).toBeUndefined();
+  });
+
+  it('throws an error if the text does not parse', () => {
+    expect(() => parseOrderBy('avg DOWN')).toThrow('Invalid sort key "avg DOWN"');
+    expect(() => parseOrderBy('avg, host NULLS')).toThrow('Invalid sort key "host NULLS"');
+  });
+});
+
+describe('parseHaving', () => {
+  it('parses conditions formatted by formatHaving', () => {
+    const having = [
+      { column: 'avg', operator: '>', value: '80' },
+      { column: 'peak cpu', operator: '<=', value: '-2.5', condition: 'OR' as const },
+    ];
+    expect(formatHaving(having)).toBe('avg > 80 OR "peak cpu" <= -2.5');
+    expect(parseHaving(formatHaving(having))).toEqual(having);
+    expect(parseHaving('')).toBeUndefined();
+  });
+
+  it('throws an error if the text does not parse', () => {
+    expect(() => parseHaving('avg')).toThrow('Invalid condition "avg"');
+    expect(() => parseHaving('avg > 80 AND peak')).toThrow('Invalid condition "AND peak"');
+    expect(parseError(() => parseHaving('avg ~ 1'))).toBe('Invalid condition "avg ~ 1", use e.g. avg > 80 AND peak < 100');
+  });
+});
+
+describe('parseError', () => {
+  it('returns the message of the parse error', () => {
+    expect(parseError(() => parseOrderBy('avg DESC'))).toBeUndefined();
+    expect(parseError(() => parseOrderBy('avg DOWN'))).toBe('Invalid sort key "avg DOWN", use e.g. avg DESC NULLS LAST, host');
+  });
+});
@@ -3,7 +3,7 @@ import { useRef } from 'react';
 
 import { SelectableValue } from '@grafana/data';
 
-import { TagItem } from './types';
+import { HavingItem, OrderByItem, TagItem } from './types';
 
 function isRegex(text: string): boolean {
   return /^\/.*\/$/.test(text);
@@ -64,3 +64,100 @@ export function adjustOperatorIfNeeded(currentOperator: string, newTagValue: str
     return isCurrentOperatorRegex ? '=' : currentOperator;
   }
 }
+
+function formatColumn(column: string): string {
+  return /^[A-Za-z_][A-Za-z0-9_]*$/.test(column) ? column : '"' + column.replace(/"/g, '""') + '"';
+}
+
+// formatOrderBy formats sort keys as text, e.g. `avg DESC NULLS LAST, "host name"`.
+export function formatOrderBy(orderBy: OrderByItem[] | undefined): string | undefined {
+  if (orderBy === undefined || orderBy.length === 0) {
+    return undefined;
+  }
+  return orderBy
+    .map((item) => {
+      let key = formatColumn(item.column);
+      if (item.direction) {
+        key += ' ' + item.direction;
+      }
+      if (item.nulls) {
+        key += ' NULLS ' + item.nulls;
+      }
+      return key;
+    })
+    .join(', ');
+}
+
+// parseOrderBy parses sort keys formatted by formatOrderBy, it throws an error if text doesn't parse.
+export function parseOrderBy(text: string | undefined): OrderByItem[] | undefined {
+  if (text === undefined || text.trim() === '') {
+    return undefined;
+  }
+  const keyRegexp = /\s*(?:"((?:[^"]|"")*)"|([^\s,]+))(?:\s+(ASC|DESC))?(?:\s+NULLS\s+(FIRST|LAST))?\s*(?:,|$)/iy;
+  const items: OrderByItem[] = [];
+  while (keyRegexp.lastIndex < text.length) {
+    const start = keyRegexp.lastIndex;
+    const match = keyRegexp.exec(text);
+    if (match === null) {
+      throw new Error(`Invalid sort key "${text.slice(start).trim()}", use e.g. avg DESC NULLS LAST, host`);
+    }
+    const item: OrderByItem = { column: match[1] !== undefined ? match[1].replace(/""/g, '"') : match[2] };
+    if (match[3]) {
+      item.direction = match[3].toUpperCase() as OrderByItem['direction'];
+    }
+    if (match[4]) {
+      item.nulls = match[4].toUpperCase() as OrderByItem['nulls'];
+    }
+    items.push(item);
+  }
+  return items.length > 0 ? items : undefined;
+}
+
+// formatHaving formats the conditions on aggregates as text, e.g. `avg > 80 OR "peak cpu" >= 95`.
+export function formatHaving(having: HavingItem[] | undefined): string | undefined {
+  if (having === undefined || having.length === 0) {
+    return undefined;
+  }
+  return having
+    .map((item, index) => {
+      const condition = index > 0 ? (item.condition ?? 'AND') + ' ' : '';
+      return condition + formatColumn(item.column) + ' ' + (item.operator ?? '=') + ' ' + item.value;
+    })
+    .join(' ');
+}
+
+// parseHaving parses conditions formatted by formatHaving, it throws an error if text doesn't parse.
+export function parseHaving(text: string | undefined): HavingItem[] | undefined {
+  if (text === undefined || text.trim() === '') {
+    return undefined;
+  }
+  const conditionRegexp = /\s*(?:(AND|OR)\s+)?(?:"((?:[^"]|"")*)"|([^\s=!<>]+))\s*(=|!=|<>|<=|>=|<|>)\s*([^\s]+)\s*/iy;
+  const items: HavingItem[] = [];
+  while (conditionRegexp.lastIndex < text.length) {
+    const start = conditionRegexp.lastIndex;
+    const match = conditionRegexp.exec(text);
+    if (match === null) {
+      throw new Error(`Invalid condition "${text.slice(start).trim()}", use e.g. avg > 80 AND peak < 100`);
+    }
+    const item: HavingItem = {
+      column: match[2] !== undefined ? match[2].replace(/""/g, '"') : match[3],
+      operator: match[4],
+      value: match[5],
+    };
+    if (match[1] && items.length > 0) {
+      item.condition = match[1].toUpperCase() as HavingItem['condition'];
+    }
+    items.push(item);
+  }
+  return items.length > 0 ? items : undefined;
+}
+
+// parseError returns the message of the error thrown by parse, or undefined if it succeeds.
+export function parseError(parse: () => unknown): string | undefined {
+  try {
+    parse();
+    return undefined;
+  } catch (e) {
+    return e instanceof Error ? e.message : String(e);
+  }
+}